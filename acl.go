@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Grantee URIs of the predefined groups that make a bucket public
+const (
+	allUsersURI           = "http://acs.amazonaws.com/groups/global/AllUsers"
+	authenticatedUsersURI = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+)
+
+// AccessControlPolicy is the XML returned by GET ?acl
+type AccessControlPolicy struct {
+	Owner struct {
+		ID          string `xml:"ID"`
+		DisplayName string `xml:"DisplayName"`
+	} `xml:"Owner"`
+	Grants []struct {
+		Grantee struct {
+			Type         string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+			ID           string `xml:"ID"`
+			DisplayName  string `xml:"DisplayName"`
+			URI          string `xml:"URI"`
+			EmailAddress string `xml:"EmailAddress"`
+		} `xml:"Grantee"`
+		Permission string `xml:"Permission"`
+	} `xml:"AccessControlList>Grant"`
+}
+
+// aclResult is the verdict on a bucket ACL
+type aclResult struct {
+	Readable    bool     // the ACL itself could be read
+	Error       string   // S3 error code or failure when it could not
+	PublicRead  bool     // a public group may list the bucket
+	PublicWrite bool     // a public group may write to the bucket or its ACL
+	Grants      []string // public grants, e.g. AllUsers:READ
+}
+
+// public reports whether the ACL grants any access to a public group
+func (r aclResult) public() bool {
+	return len(r.Grants) > 0
+}
+
+// String summarizes the verdict, e.g. "public-read (AllUsers:READ)"
+func (r aclResult) String() string {
+	if !r.Readable {
+		return "unknown (" + r.Error + ")"
+	}
+	var parts []string
+	if r.PublicRead {
+		parts = append(parts, "public-read")
+	}
+	if r.PublicWrite {
+		parts = append(parts, "public-write")
+	}
+	if len(r.Grants) == 0 {
+		return "private"
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "public-read-acp")
+	}
+	return strings.Join(parts, ", ") + " (" + strings.Join(r.Grants, ", ") + ")"
+}
+
+// subresourceURL returns the URL of a bucket subresource such as ?acl,
+// keeping any query of the bucket URL
+func subresourceURL(bucketURL, name string) (string, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return "", err
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += name
+	return u.String(), nil
+}
+
+// getSubresource fetches a bucket subresource. Error responses are returned
+// with their body so the S3 error code can be reported.
+func getSubresource(bucketURL, name string) (*http.Response, []byte, error) {
+	subURL, err := subresourceURL(bucketURL, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := httpClient.Get(subURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// s3ErrorCode returns the S3 error code of an error response, or the HTTP status
+func s3ErrorCode(statusCode int, body []byte) string {
+	var s3Err S3Error
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return s3Err.Code
+	}
+	return fmt.Sprintf("status %d", statusCode)
+}
+
+// checkBucketACL reads the ACL of a bucket and reports the grants given to
+// the AllUsers and AuthenticatedUsers groups. Many buckets deny ?acl even when
+// their objects are readable, so an unreadable ACL is not treated as private.
+func checkBucketACL(bucketURL string) aclResult {
+	resp, body, err := getSubresource(bucketURL, "acl")
+	if err != nil {
+		debugLog("Failed to read the ACL of %s: %v", bucketURL, err)
+		return aclResult{Error: "request failed"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return aclResult{Error: s3ErrorCode(resp.StatusCode, body)}
+	}
+	var policy AccessControlPolicy
+	if err := xml.Unmarshal(body, &policy); err != nil {
+		debugLog("Error parsing the ACL of %s: %v", bucketURL, err)
+		return aclResult{Error: "parse error"}
+	}
+
+	result := aclResult{Readable: true}
+	for _, grant := range policy.Grants {
+		var group string
+		switch grant.Grantee.URI {
+		case allUsersURI:
+			group = "AllUsers"
+		case authenticatedUsersURI:
+			group = "AuthenticatedUsers"
+		default:
+			continue
+		}
+		result.Grants = append(result.Grants, group+":"+grant.Permission)
+		switch grant.Permission {
+		case "READ":
+			result.PublicRead = true
+		case "WRITE", "WRITE_ACP":
+			result.PublicWrite = true
+		case "FULL_CONTROL":
+			result.PublicRead, result.PublicWrite = true, true
+		}
+	}
+	return result
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// outputArchive receives every download when -zip or -tar is set, instead of individual files
+var outputArchive *archiveSink
+
+// archiveWriter writes entries to an archive format. It is not safe for concurrent
+// use; archiveSink serializes all calls through one goroutine.
+type archiveWriter interface {
+	add(name string, modTime time.Time, size int64, content io.Reader) error
+	Close() error
+}
+
+// archiveEntry is a completed download waiting to be written to the archive
+type archiveEntry struct {
+	name     string // "/"-separated path inside the archive
+	modTime  time.Time
+	tempFile string // downloaded content, removed once written
+}
+
+// archiveSink funnels completed downloads to a single writer goroutine
+type archiveSink struct {
+	file    *os.File
+	writer  archiveWriter
+	entries chan archiveEntry
+	done    chan struct{}
+	written int
+	failed  int
+}
+
+// openArchive creates the archive file and starts the writer goroutine
+func openArchive(path string, newWriter func(io.Writer) archiveWriter) *archiveSink {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Failed to create archive %s: %v", path, err)
+	}
+	sink := &archiveSink{
+		file:    file,
+		writer:  newWriter(file),
+		entries: make(chan archiveEntry, 16),
+		done:    make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+// run writes submitted entries until the entries channel is closed
+func (a *archiveSink) run() {
+	defer close(a.done)
+	for entry := range a.entries {
+		if err := a.write(entry); err != nil {
+			debugLog("Failed to add %s to %s: %v", entry.name, a.file.Name(), err)
+			a.failed++
+		} else {
+			a.written++
+		}
+		os.Remove(entry.tempFile)
+	}
+}
+
+func (a *archiveSink) write(entry archiveEntry) error {
+	file, err := os.Open(entry.tempFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return a.writer.add(entry.name, entry.modTime, info.Size(), file)
+}
+
+// close waits for the pending entries and finalizes the archive
+func (a *archiveSink) close() {
+	close(a.entries)
+	<-a.done
+	if err := a.writer.Close(); err != nil {
+		log.Printf("Failed to finalize archive %s: %v", a.file.Name(), err)
+	}
+	if err := a.file.Close(); err != nil {
+		log.Printf("Failed to close archive %s: %v", a.file.Name(), err)
+	}
+	fmt.Printf("Wrote %d entries to %s\n", a.written, a.file.Name())
+	if a.failed > 0 {
+		log.Printf("Failed to add %d entries to %s", a.failed, a.file.Name())
+	}
+}
+
+// saveToArchive stores a download in a temporary file and queues it for the archive
+func saveToArchive(object s3Object, resp *http.Response, content io.Reader) error {
+	temp, err := os.CreateTemp("", "s3explorer-*")
+	if err != nil {
+		debugLog("Failed to create temporary file: %v", err)
+		return err
+	}
+	_, err = io.Copy(temp, content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		debugLog("Failed to save content for %s: %v", object.url(), err)
+		os.Remove(temp.Name())
+		return err
+	}
+
+	modTime := time.Now()
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		modTime = lastModified
+	}
+	outputArchive.entries <- archiveEntry{name: archiveName(object), modTime: modTime, tempFile: temp.Name()}
+	return nil
+}
+
+// archiveName returns the path of an object inside the archive, as assigned by
+// assignUniquePaths if the object is part of a batch
+func archiveName(object s3Object) string {
+	if name, ok := uniquePaths[object.url()]; ok {
+		return name
+	}
+	return renderArchiveName(object)
+}
+
+// renderArchiveName returns the full key of an object (or the -name-template
+// result, or the -flatten name), below the bucket directory with -by-bucket
+func renderArchiveName(object s3Object) string {
+	name := sanitizeRelativePath(namingKey(object))
+	if nameTemplate != nil {
+		name = templateName(object)
+	} else if *flatten {
+		name = flattenedName(object)
+	}
+	if name == "" {
+		name = "_"
+	}
+	if *gunzip {
+		name = gunzippedName(name)
+	}
+	name = renameExt.rename(name)
+	if *byBucket {
+		name = filepath.Join(bucketDirName(object.Bucket), name)
+	}
+	return filepath.ToSlash(name)
+}
+
+// zipArchive writes archive entries to a zip file
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func newZipArchive(w io.Writer) archiveWriter {
+	return &zipArchive{w: zip.NewWriter(w)}
+}
+
+func (z *zipArchive) add(name string, modTime time.Time, size int64, content io.Reader) error {
+	entry, err := z.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+func (z *zipArchive) Close() error {
+	return z.w.Close()
+}
+
+// tarArchive writes archive entries to a gzip-compressed tar file
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarArchive(w io.Writer) archiveWriter {
+	gz := gzip.NewWriter(w)
+	return &tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (t *tarArchive) add(name string, modTime time.Time, size int64, content io.Reader) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	}
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.tw, content)
+	return err
+}
+
+func (t *tarArchive) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
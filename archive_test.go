@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// archiveFixture are the entries written by the archive tests, in order
+var archiveFixture = []struct {
+	name    string
+	content string
+}{
+	{"logs/a.txt", "first line\nsecond line\n"},
+	{"empty.txt", ""},
+	{"bucket.test/dir/b.json", `{"key":"value"}`},
+}
+
+// archiveModTime is the modification time of every fixture entry
+var archiveModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// writeFixture adds the fixture entries to an archive writer and closes it
+func writeFixture(t *testing.T, w archiveWriter) {
+	t.Helper()
+	for _, entry := range archiveFixture {
+		if err := w.add(entry.name, archiveModTime, int64(len(entry.content)), strings.NewReader(entry.content)); err != nil {
+			t.Fatalf("add %s: %v", entry.name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkEntry compares an entry read back from an archive with the fixture
+func checkEntry(t *testing.T, i int, name string, modTime time.Time, content io.Reader) {
+	t.Helper()
+	if i >= len(archiveFixture) {
+		t.Fatalf("unexpected entry %s", name)
+	}
+	want := archiveFixture[i]
+	data, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != want.name || string(data) != want.content {
+		t.Errorf("entry %d is %s with %q, want %s with %q", i, name, data, want.name, want.content)
+	}
+	if !modTime.Equal(archiveModTime) {
+		t.Errorf("%s modified at %v, want %v", name, modTime, archiveModTime)
+	}
+}
+
+func TestZipArchiveRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	writeFixture(t, newZipArchive(&out))
+
+	r, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != len(archiveFixture) {
+		t.Fatalf("got %d entries, want %d", len(r.File), len(archiveFixture))
+	}
+	for i, file := range r.File {
+		content, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEntry(t, i, file.Name, file.Modified, content)
+		content.Close()
+	}
+}
+
+func TestTarArchiveRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	writeFixture(t, newTarArchive(&out))
+
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tar.NewReader(gz)
+	count := 0
+	for ; ; count++ {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg || header.Mode != 0o644 {
+			t.Errorf("%s has type %c and mode %o, want a regular file with mode 644", header.Name, header.Typeflag, header.Mode)
+		}
+		checkEntry(t, count, header.Name, header.ModTime, r)
+	}
+	if count != len(archiveFixture) {
+		t.Errorf("got %d entries, want %d", count, len(archiveFixture))
+	}
+}
+
+// Entries go through the sink's temporary files and writer goroutine, which
+// removes each temporary file once written
+func TestArchiveSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.zip")
+	sink := openArchive(path, newZipArchive)
+	var temps []string
+	for _, entry := range archiveFixture {
+		temp := filepath.Join(dir, strings.ReplaceAll(entry.name, "/", "_")+".tmp")
+		if err := os.WriteFile(temp, []byte(entry.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		temps = append(temps, temp)
+		sink.entries <- archiveEntry{name: entry.name, modTime: archiveModTime, tempFile: temp}
+	}
+	sink.close()
+
+	if sink.written != len(archiveFixture) || sink.failed != 0 {
+		t.Errorf("written %d and failed %d, want %d and 0", sink.written, sink.failed, len(archiveFixture))
+	}
+	for _, temp := range temps {
+		if _, err := os.Stat(temp); !os.IsNotExist(err) {
+			t.Errorf("temporary file %s was not removed", temp)
+		}
+	}
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i, file := range r.File {
+		content, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEntry(t, i, file.Name, file.Modified, content)
+		content.Close()
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Severity labels of audit findings, from most to least severe
+const (
+	severityHigh   = "high"
+	severityMedium = "medium"
+	severityLow    = "low"
+	severityInfo   = "info"
+)
+
+// severityRank orders findings within a bucket, most severe first
+var severityRank = map[string]int{severityHigh: 0, severityMedium: 1, severityLow: 2, severityInfo: 3}
+
+// auditCheckNames are the checks run by -audit, which -audit-skip can disable
+var auditCheckNames = []string{"listing", "acl", "website", "cors", "tags", "methods", "sse", "write"}
+
+// finding is the result of one audit check on a bucket
+type finding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+}
+
+// bucketAudit is the consolidated -audit report of one bucket
+type bucketAudit struct {
+	URL      string    `json:"url"`
+	Findings []finding `json:"findings"`
+}
+
+// audits holds the report of every audited bucket, in the order they were audited
+var audits []*bucketAudit
+
+// auditSkipped holds the checks disabled with -audit-skip, set by run
+var auditSkipped map[string]bool
+
+// auditModifying are the -audit checks that send requests which could change
+// the bucket. They only run with -audit-write.
+var auditModifying = map[string][]string{
+	"methods": {http.MethodDelete},
+	"write":   {http.MethodPut, http.MethodDelete},
+}
+
+// parseAuditSkip validates -audit-skip and returns the skipped checks
+func parseAuditSkip(value string) (map[string]bool, error) {
+	skipped := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		known := false
+		for _, check := range auditCheckNames {
+			known = known || check == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown audit check %q, expected one of %s", name, strings.Join(auditCheckNames, ", "))
+		}
+		skipped[name] = true
+	}
+	return skipped, nil
+}
+
+// auditEnabled reports whether -audit runs the named check
+func auditEnabled(check string) bool {
+	_, modifying := auditModifying[check]
+	return *audit && !auditSkipped[check] && (!modifying || *auditWrite)
+}
+
+// auditBucket runs the bucket configuration checks selected with -only-public,
+// -website, -cors, -tags, -probe-methods or -audit before the bucket is listed. The standalone checks
+// print their results to stderr, while -audit collects them as findings. It
+// reports whether the bucket should be listed.
+func auditBucket(bucketURL string) bool {
+	var report *bucketAudit
+	if *audit {
+		report = &bucketAudit{URL: bucketURL}
+		audits = append(audits, report)
+	}
+
+	if *onlyPublic || auditEnabled("acl") {
+		acl := checkBucketACL(bucketURL)
+		if report != nil {
+			report.add("acl", aclSeverity(acl), acl.String())
+		}
+		if *onlyPublic {
+			fmt.Fprintf(os.Stderr, "ACL of %s: %s\n", bucketURL, acl)
+			if acl.Readable && !acl.public() {
+				fmt.Fprintf(os.Stderr, "Skipping %s, its ACL grants no public access\n", bucketURL)
+				return false
+			}
+		}
+	}
+	if *websiteCheck || auditEnabled("website") {
+		website := checkBucketWebsite(bucketURL)
+		if report != nil {
+			severity := severityInfo
+			if website.Configured {
+				severity = severityLow
+			}
+			report.add("website", severity, website.String())
+		}
+		if *websiteCheck {
+			fmt.Fprintf(os.Stderr, "Website of %s: %s\n", bucketURL, website)
+		}
+	}
+	if *corsCheck || auditEnabled("cors") {
+		cors := checkBucketCORS(bucketURL)
+		if report != nil {
+			report.add("cors", corsSeverity(cors), cors.String())
+		}
+		if *corsCheck {
+			fmt.Fprintf(os.Stderr, "CORS of %s: %s\n", bucketURL, cors)
+		}
+	}
+	if *tagsFlag || auditEnabled("tags") {
+		tags := checkTagging(bucketURL)
+		if report != nil {
+			// Tags often name owners, projects or data classifications
+			severity := severityInfo
+			if len(tags.Tags) > 0 {
+				severity = severityLow
+			}
+			report.add("tags", severity, tags.String())
+		}
+		if *tagsFlag {
+			fmt.Fprintf(os.Stderr, "Tags of %s: %s\n", bucketURL, tags)
+		}
+	}
+	if len(probedMethods) > 0 {
+		probeBucketMethods(bucketURL)
+	}
+	if methods := auditModifyingMethods(); len(methods) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: sending %s requests to %s, which can modify the bucket (-audit-write)\n", strings.Join(methods, ", "), bucketURL)
+	}
+	if auditEnabled("methods") {
+		options, del := probeMethod(bucketURL, http.MethodOptions), probeMethod(bucketURL, http.MethodDelete)
+		report.add("methods", methodsSeverity(options, del), options.String()+", "+del.String())
+	}
+	if auditEnabled("write") {
+		severity, summary := probeWrite(bucketURL)
+		report.add("write", severity, summary)
+	}
+	return !*audit || auditEnabled("listing")
+}
+
+// auditModifyingMethods returns the modifying methods the enabled -audit
+// checks send, in the order they are first sent
+func auditModifyingMethods() []string {
+	var methods []string
+	for _, check := range auditCheckNames {
+		if !auditEnabled(check) {
+			continue
+		}
+		for _, method := range auditModifying[check] {
+			if !slices.Contains(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+	}
+	return methods
+}
+
+// auditListing adds the outcome of listing a bucket to its -audit report
+func auditListing(listing bucketListing) {
+	if !auditEnabled("listing") {
+		return
+	}
+	for _, report := range audits {
+		if report.URL != listing.URL {
+			continue
+		}
+		switch listing.Status {
+		case listingOK:
+			summary := fmt.Sprintf("publicly listable, %d keys listed", len(listing.Objects))
+			if listing.Truncated {
+				summary += " (more available)"
+			}
+			report.add("listing", severityMedium, summary)
+			if auditEnabled("sse") {
+				severity, summary := checkListedEncryption(listing.Objects)
+				report.add("sse", severity, summary)
+			}
+		case listingEmpty:
+			report.add("listing", severityLow, "publicly listable, empty")
+		case listingUnchanged:
+			report.add("listing", severityMedium, "publicly listable, unchanged since the last -state run")
+		default:
+			report.add("listing", severityInfo, "not listable ("+strings.ReplaceAll(string(listing.Status), "_", " ")+")")
+		}
+		return
+	}
+}
+
+// add records a finding in the report
+func (a *bucketAudit) add(check, severity, summary string) {
+	a.Findings = append(a.Findings, finding{Check: check, Severity: severity, Summary: summary})
+}
+
+// aclSeverity rates an ACL: writable by the public is high, readable medium
+func aclSeverity(acl aclResult) string {
+	switch {
+	case acl.PublicWrite:
+		return severityHigh
+	case acl.PublicRead:
+		return severityMedium
+	case acl.public():
+		return severityLow
+	}
+	return severityInfo
+}
+
+// corsSeverity rates CORS rules: any origin may modify objects is medium,
+// any origin may read them is low
+func corsSeverity(cors corsResult) string {
+	severity := severityInfo
+	for _, rule := range cors.Rules {
+		anyOrigin := false
+		for _, origin := range rule.AllowedOrigins {
+			anyOrigin = anyOrigin || origin == "*"
+		}
+		if !anyOrigin {
+			continue
+		}
+		severity = severityLow
+		for _, method := range rule.AllowedMethods {
+			if method == http.MethodPut || method == http.MethodPost || method == http.MethodDelete {
+				return severityMedium
+			}
+		}
+	}
+	return severity
+}
+
+// probeWrite tries to upload a small uniquely named object to the bucket and
+// deletes it again if that succeeded
+func probeWrite(bucketURL string) (string, string) {
+	object := s3Object{Bucket: bucketURL, Key: probeKey("s3explorer-write-probe-")}
+
+	req, err := http.NewRequest(http.MethodPut, object.url(), bytes.NewReader([]byte("s3explorer write probe\n")))
+	if err != nil {
+		return severityInfo, "not tested (" + err.Error() + ")"
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		debugLog("Write probe of %s failed: %v", bucketURL, err)
+		return severityInfo, "not tested (request failed)"
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return severityInfo, "not writable (" + s3ErrorCode(resp.StatusCode, body) + ")"
+	}
+
+	summary := "publicly writable, uploaded " + object.Key
+	req, _ = http.NewRequest(http.MethodDelete, object.url(), nil)
+	if resp, err := httpClient.Do(req); err == nil && resp.StatusCode < 300 {
+		resp.Body.Close()
+		return severityHigh, summary + " and deleted it"
+	} else if err == nil {
+		resp.Body.Close()
+	}
+	return severityHigh, summary + ", deleting it failed"
+}
+
+// probeKey returns a random key name with the given prefix, for probe objects
+func probeKey(prefix string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return prefix + hex.EncodeToString(suffix) + ".txt"
+}
+
+// printAudits writes the -audit report of every bucket, most severe findings first
+func printAudits(w io.Writer) {
+	for _, report := range sortedAudits() {
+		fmt.Fprintf(w, "Audit of %s:\n", report.URL)
+		for _, f := range report.Findings {
+			fmt.Fprintf(w, "  %-8s %-8s %s\n", "["+strings.ToUpper(f.Severity)+"]", f.Check, f.Summary)
+		}
+	}
+}
+
+// sortedAudits returns the audit reports with the findings of each bucket
+// ordered by severity, keeping the check order otherwise
+func sortedAudits() []*bucketAudit {
+	for _, report := range audits {
+		findings := report.Findings
+		sort.SliceStable(findings, func(i, j int) bool {
+			return severityRank[findings[i].Severity] < severityRank[findings[j].Severity]
+		})
+	}
+	return audits
+}
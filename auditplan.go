@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// plannedRequest is one request -audit would send, as printed by -dry-run
+type plannedRequest struct {
+	Check  string
+	Method string
+	URL    string
+	Note   string // when the request is only sent under some condition
+}
+
+// modifies reports whether the request could change the bucket
+func (r plannedRequest) modifies() bool {
+	return modifyingMethods[r.Method]
+}
+
+// planAudit returns the requests auditBucket and the listing would send to a
+// bucket, in the order they are sent. Probe objects get a random name at run
+// time, shown as <random>.
+func planAudit(bucketURL string, prefixes []string) []plannedRequest {
+	var plan []plannedRequest
+	subresource := func(check, name string) {
+		subURL, err := subresourceURL(bucketURL, name)
+		if err != nil {
+			subURL = bucketURL + "?" + name
+		}
+		plan = append(plan, plannedRequest{Check: check, Method: http.MethodGet, URL: subURL})
+	}
+	probeObject := func(prefix string) string {
+		return s3Object{Bucket: bucketURL, Key: prefix + "<random>.txt"}.url()
+	}
+	writeProbe := func(check string) {
+		objectURL := probeObject("s3explorer-write-probe-")
+		plan = append(plan,
+			plannedRequest{Check: check, Method: http.MethodPut, URL: objectURL},
+			plannedRequest{Check: check, Method: http.MethodDelete, URL: objectURL, Note: "only if the upload succeeded"})
+	}
+	method := func(check, method string) {
+		switch method {
+		case http.MethodPut:
+			writeProbe(check)
+		case http.MethodDelete:
+			plan = append(plan, plannedRequest{Check: check, Method: method, URL: probeObject("s3explorer-method-probe-"), Note: "key that does not exist"})
+		default:
+			plan = append(plan, plannedRequest{Check: check, Method: method, URL: bucketURL})
+		}
+	}
+
+	if *onlyPublic || auditEnabled("acl") {
+		subresource("acl", "acl")
+	}
+	if *websiteCheck || auditEnabled("website") {
+		subresource("website", "website")
+	}
+	if *corsCheck || auditEnabled("cors") {
+		subresource("cors", "cors")
+	}
+	if *tagsFlag || auditEnabled("tags") {
+		subresource("tags", "tagging")
+	}
+	for _, m := range probedMethods {
+		method("probe-methods", m)
+	}
+	if auditEnabled("methods") {
+		method("methods", http.MethodOptions)
+		method("methods", http.MethodDelete)
+	}
+	if auditEnabled("write") {
+		writeProbe("write")
+	}
+
+	if !auditEnabled("listing") {
+		return plan
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		pageURL, err := listURL(bucketURL, prefix, pageToken{})
+		if err != nil {
+			pageURL = bucketURL
+		}
+		plan = append(plan, plannedRequest{Check: "listing", Method: *listMethod, URL: pageURL, Note: "and one per further page up to -l"})
+	}
+	if auditEnabled("sse") {
+		plan = append(plan, plannedRequest{Check: "sse", Method: http.MethodHead, URL: bucketURL + "/<key>",
+			Note: fmt.Sprintf("for each of the first %d listed keys", sseSampleKeys)})
+	}
+	return plan
+}
+
+// printAuditPlan writes the requests -audit would send to every bucket,
+// followed by a count per check and method, without sending any of them
+func printAuditPlan(w io.Writer, bucketURLs []string, prefixes []string) {
+	checks := make(map[string]int)
+	methods := make(map[string]int)
+	var checkOrder, methodOrder []string
+	total, modifying := 0, 0
+	for _, bucketURL := range bucketURLs {
+		fmt.Fprintf(w, "Audit plan for %s:\n", bucketURL)
+		for _, r := range planAudit(bucketURL, prefixes) {
+			line := fmt.Sprintf("  %-8s %-13s %s", r.Method, r.Check, r.URL)
+			if r.Note != "" {
+				line += " (" + r.Note + ")"
+			}
+			fmt.Fprintln(w, line)
+
+			if checks[r.Check] == 0 {
+				checkOrder = append(checkOrder, r.Check)
+			}
+			if methods[r.Method] == 0 {
+				methodOrder = append(methodOrder, r.Method)
+			}
+			checks[r.Check]++
+			methods[r.Method]++
+			total++
+			if r.modifies() {
+				modifying++
+			}
+		}
+	}
+
+	var byCheck, byMethod []string
+	for _, check := range checkOrder {
+		byCheck = append(byCheck, fmt.Sprintf("%s %d", check, checks[check]))
+	}
+	for _, method := range methodOrder {
+		byMethod = append(byMethod, fmt.Sprintf("%s %d", method, methods[method]))
+	}
+	fmt.Fprintf(w, "Planned requests: at least %d, %d of them can modify a bucket (buckets: %d)\n", total, modifying, len(bucketURLs))
+	if total > 0 {
+		fmt.Fprintf(w, "  By check:  %s\n", strings.Join(byCheck, ", "))
+		fmt.Fprintf(w, "  By method: %s\n", strings.Join(byMethod, ", "))
+	}
+}
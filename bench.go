@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// hiddenFlags are left out of the usage message
+var hiddenFlags = map[string]bool{"bench": true}
+
+// usage prints the defaults of every flag except the hidden ones
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// benchThreads are the concurrency levels measured by -bench, besides -t
+var benchThreads = []int{1, 4, 16}
+
+// runBench downloads the same objects once per combination of concurrency
+// level and keepalive setting, into a temporary directory, and prints the
+// throughput of each run
+func runBench(objects []s3Object) int {
+	if len(objects) == 0 {
+		log.Printf("Nothing to benchmark, no keys were listed")
+		return exitOK
+	}
+	dir, err := os.MkdirTemp("", "s3explorer-bench-")
+	if err != nil {
+		log.Fatalf("Failed to create a directory for -bench: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		log.Fatalf("Failed to enter %s: %v", dir, err)
+	}
+	*noOverwrite, *skipExisting = false, false
+
+	levels := append([]int{*threads}, benchThreads...)
+	sort.Ints(levels)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "threads\tkeepalive\tkeys\tfailed\tbytes\ttime\tthroughput")
+	for i, level := range levels {
+		if i > 0 && level == levels[i-1] {
+			continue
+		}
+		for _, keepAlive := range []bool{true, false} {
+			*threads, *disableKeepAlive = level, !keepAlive
+			configureHTTPClient()
+			bytes, failed, elapsed := benchRun(objects, level)
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\t%s/s\n", level, onOff(keepAlive), len(objects), failed,
+				formatBytes(bytes), elapsed.Round(time.Millisecond), formatBytes(int64(float64(bytes)/elapsed.Seconds())))
+		}
+	}
+	w.Flush()
+	return exitOK
+}
+
+// benchRun downloads the objects with the given concurrency and returns the
+// bytes read, the number of failed downloads and the time it took
+func benchRun(objects []s3Object, concurrency int) (int64, int, time.Duration) {
+	var bytes atomic.Int64
+	var failed atomic.Int32
+	count := func(n int64) { bytes.Add(n) }
+
+	start := time.Now()
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, object := range objects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(o s3Object) {
+			defer wg.Done()
+			if !downloadAndSave(o, count) {
+				failed.Add(1)
+			}
+			<-sem
+		}(object)
+	}
+	wg.Wait()
+	return bytes.Load(), int(failed.Load()), time.Since(start)
+}
+
+// onOff formats a boolean for the -bench table
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
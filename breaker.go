@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// bucketBreaker stops requests to a bucket once -max-errors-per-bucket of its
+// downloads or -grep/-secrets reads failed in a row, so a bucket that denies
+// every GET does not take up the rest of the run. Any success resets the
+// count; once tripped, the bucket stays skipped until the end of the run.
+type bucketBreaker struct {
+	mu          sync.Mutex
+	consecutive map[string]int // bucket URL -> failures since the last success
+	tripped     map[string]int // bucket URL -> keys skipped since it tripped
+	order       []string       // tripped buckets in the order they tripped
+}
+
+// breaker is the circuit breaker shared by all downloads and body scans
+var breaker = &bucketBreaker{consecutive: make(map[string]int), tripped: make(map[string]int)}
+
+// failure counts a failed request for an object and trips its bucket at the
+// threshold
+func (b *bucketBreaker) failure(object s3Object) {
+	if *maxBucketErrors <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.tripped[object.Bucket]; ok {
+		return
+	}
+	b.consecutive[object.Bucket]++
+	if b.consecutive[object.Bucket] >= *maxBucketErrors {
+		b.tripped[object.Bucket] = 0
+		b.order = append(b.order, object.Bucket)
+		debugLog("Skipping the remaining keys of %s after %d failures in a row (-max-errors-per-bucket)", object.Bucket, b.consecutive[object.Bucket])
+	}
+}
+
+// success resets the failure count of an object's bucket
+func (b *bucketBreaker) success(object s3Object) {
+	if *maxBucketErrors <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.consecutive, object.Bucket)
+}
+
+// skip reports whether the bucket of an object has tripped, counting the
+// object as skipped if so
+func (b *bucketBreaker) skip(object s3Object) bool {
+	if *maxBucketErrors <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	skipped, ok := b.tripped[object.Bucket]
+	if ok {
+		b.tripped[object.Bucket] = skipped + 1
+	}
+	return ok
+}
+
+// isTripped reports whether requests to a bucket were stopped
+func (b *bucketBreaker) isTripped(bucketURL string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.tripped[bucketURL]
+	return ok
+}
+
+// report logs every bucket that tripped and the number of its keys skipped
+func (b *bucketBreaker) report() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, bucketURL := range b.order {
+		log.Printf("Stopped requests to %s after %d failures in a row (-max-errors-per-bucket), %d keys skipped", bucketURL, *maxBucketErrors, b.tripped[bucketURL])
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// browser is the state of an interactive -tui session: the key tree, the
+// directories entered from the root and the objects by tree path
+type browser struct {
+	in      *bufio.Scanner
+	out     io.Writer
+	objects []s3Object
+	byPath  map[string]s3Object
+	stack   []*treeNode
+}
+
+// browseKeys lets the user walk the listed keys like a file system and
+// download single keys or whole prefixes, until q is entered or in is exhausted
+func browseKeys(in io.Reader, out io.Writer, objects []s3Object) {
+	b := &browser{
+		in:      bufio.NewScanner(in),
+		out:     out,
+		objects: objects,
+		byPath:  make(map[string]s3Object, len(objects)),
+		stack:   []*treeNode{buildKeyTree(objects)},
+	}
+	for _, object := range objects {
+		b.byPath[treePath(object)] = object
+	}
+
+	b.list()
+	for {
+		fmt.Fprintf(b.out, "%s> ", b.dir())
+		if !b.in.Scan() {
+			fmt.Fprintln(b.out)
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimSpace(b.in.Text()), " ")
+		switch command {
+		case "":
+		case "q", "quit":
+			return
+		case "?", "help":
+			fmt.Fprintln(b.out, "Commands: N open entry N, .. go up, ls list, d N download entry N, d download everything here, q quit")
+		case "ls":
+			b.list()
+		case "..":
+			if len(b.stack) > 1 {
+				b.stack = b.stack[:len(b.stack)-1]
+			}
+			b.list()
+		case "d":
+			b.download(arg)
+		default:
+			b.open(command)
+		}
+	}
+}
+
+// dir returns the tree path of the current directory, "/" at the root
+func (b *browser) dir() string {
+	var names []string
+	for _, node := range b.stack[1:] {
+		names = append(names, node.name)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// childPath returns the tree path of a child of the current directory
+func (b *browser) childPath(child *treeNode) string {
+	return strings.TrimPrefix(b.dir()+"/"+child.name, "/")
+}
+
+// list prints the numbered entries of the current directory
+func (b *browser) list() {
+	for i, child := range b.current().sortedChildren() {
+		name := child.name
+		if len(child.children) > 0 {
+			name += "/"
+		}
+		fmt.Fprintf(b.out, "%4d  %10s  %s\n", i+1, formatBytes(child.size), name)
+	}
+}
+
+// current returns the directory the user is in
+func (b *browser) current() *treeNode {
+	return b.stack[len(b.stack)-1]
+}
+
+// entry returns the child of the current directory numbered arg by list
+func (b *browser) entry(arg string) (*treeNode, bool) {
+	children := b.current().sortedChildren()
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(children) {
+		fmt.Fprintf(b.out, "No entry %q, enter ? for help\n", arg)
+		return nil, false
+	}
+	return children[n-1], true
+}
+
+// open enters a directory, or shows the details of a key
+func (b *browser) open(arg string) {
+	child, ok := b.entry(arg)
+	if !ok {
+		return
+	}
+	if len(child.children) > 0 {
+		b.stack = append(b.stack, child)
+		b.list()
+		return
+	}
+	object := b.byPath[b.childPath(child)]
+	size := "unknown"
+	if object.Size >= 0 {
+		size = formatBytes(object.Size)
+	}
+	fmt.Fprintf(b.out, "Key:  %s\nURL:  %s\nSize: %s\n", object.Key, object.url(), size)
+}
+
+// download fetches the entry numbered arg, or everything below the current
+// directory when arg is empty
+func (b *browser) download(arg string) {
+	prefix := strings.TrimPrefix(b.dir(), "/")
+	if arg != "" {
+		child, ok := b.entry(arg)
+		if !ok {
+			return
+		}
+		prefix = b.childPath(child)
+		if object, ok := b.byPath[prefix]; ok && len(child.children) == 0 {
+			if downloadAndSave(object, nil) {
+				fmt.Fprintf(b.out, "Downloaded %s\n", object.displayKey())
+			} else {
+				fmt.Fprintf(b.out, "Failed to download %s\n", object.url())
+			}
+			return
+		}
+	}
+
+	var selected []s3Object
+	for _, object := range b.objects {
+		if path := treePath(object); prefix == "" || strings.HasPrefix(path, prefix+"/") {
+			selected = append(selected, object)
+		}
+	}
+	downloadAllKeys(selected, *threads)
+}
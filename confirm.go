@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// confirmDownloads asks on the terminal before a batch larger than
+// -confirm-keys keys or -confirm-bytes bytes is downloaded, and exits if the
+// answer is not yes. Keys already downloaded according to -state are not
+// counted. Without a terminal to ask on, such a batch requires -y.
+func confirmDownloads(objects []s3Object) {
+	if *assumeYes {
+		return
+	}
+	count, size, unknown := 0, int64(0), 0
+	for _, object := range objects {
+		if state.keyDone(object) {
+			continue
+		}
+		count++
+		if object.Size < 0 {
+			unknown++
+		} else {
+			size += object.Size
+		}
+	}
+	if (*confirmKeys <= 0 || count <= *confirmKeys) && (*confirmBytes <= 0 || size <= *confirmBytes) {
+		return
+	}
+
+	summary := fmt.Sprintf("%d keys, %s", count, formatBytes(size))
+	if unknown > 0 {
+		summary = fmt.Sprintf("%d keys, at least %s (%d of unknown size)", count, formatBytes(size), unknown)
+	}
+	if !isTerminal(os.Stdin) {
+		log.Fatalf("Refusing to download %s without confirmation, pass -y to proceed (-confirm-keys, -confirm-bytes)", summary)
+	}
+	if !askYesNo(os.Stdin, os.Stderr, "Download "+summary+"?") {
+		log.Fatal("Download cancelled")
+	}
+}
+
+// askYesNo prints a question and reports whether the answer starts with y
+func askYesNo(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+)
+
+// CORSConfiguration is the XML returned by GET ?cors
+type CORSConfiguration struct {
+	Rules []corsRule `xml:"CORSRule"`
+}
+
+// corsRule is a single rule of a CORS configuration
+type corsRule struct {
+	AllowedOrigins []string `xml:"AllowedOrigin"`
+	AllowedMethods []string `xml:"AllowedMethod"`
+	AllowedHeaders []string `xml:"AllowedHeader"`
+	ExposeHeaders  []string `xml:"ExposeHeader"`
+	MaxAgeSeconds  int      `xml:"MaxAgeSeconds"`
+}
+
+// String summarizes a rule, e.g. "GET, PUT from *"
+func (r corsRule) String() string {
+	return strings.Join(r.AllowedMethods, ", ") + " from " + strings.Join(r.AllowedOrigins, ", ")
+}
+
+// corsResult is what a bucket's CORS configuration shows
+type corsResult struct {
+	Readable bool   // the configuration could be read, or is known to be absent
+	Error    string // S3 error code when the configuration could not be read
+	Rules    []corsRule
+}
+
+// String summarizes the configuration with one entry per rule
+func (r corsResult) String() string {
+	switch {
+	case !r.Readable:
+		return "unknown (" + r.Error + ")"
+	case len(r.Rules) == 0:
+		return "not configured (" + r.Error + ")"
+	}
+	rules := make([]string, len(r.Rules))
+	for i, rule := range r.Rules {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, "; ")
+}
+
+// checkBucketCORS reads the CORS configuration of a bucket. A bucket without
+// one answers NoSuchCORSConfiguration.
+func checkBucketCORS(bucketURL string) corsResult {
+	resp, body, err := getSubresource(bucketURL, "cors")
+	if err != nil {
+		debugLog("Failed to read the CORS configuration of %s: %v", bucketURL, err)
+		return corsResult{Error: "request failed"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		code := s3ErrorCode(resp.StatusCode, body)
+		return corsResult{Readable: code == "NoSuchCORSConfiguration", Error: code}
+	}
+	var config CORSConfiguration
+	if err := xml.Unmarshal(body, &config); err != nil {
+		debugLog("Error parsing the CORS configuration of %s: %v", bucketURL, err)
+		return corsResult{Error: "parse error"}
+	}
+	return corsResult{Readable: true, Rules: config.Rules}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// printKeyCounts prints the number of keys of every bucket that was listed
+// with at least one key, in listing order. The count is taken after -f and
+// the other filters; buckets cut off by -l are marked with a "+".
+func printKeyCounts(w io.Writer, objects []s3Object, listings []bucketListing) {
+	counts := make(map[string]int)
+	for _, object := range objects {
+		counts[object.Bucket]++
+	}
+	total := 0
+	for _, listing := range listings {
+		count, ok := counts[listing.URL]
+		if !ok {
+			continue
+		}
+		more := " "
+		if listing.Truncated {
+			more = "+"
+		}
+		fmt.Fprintf(w, "%8d%s  %s\n", count, more, listing.URL)
+		total += count
+	}
+	fmt.Fprintf(w, "%8d   total\n", total)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minBase64Segment is the shortest key segment -decode-base64 attempts to
+// decode; shorter ones decode to noise too often
+const minBase64Segment = 8
+
+// base64Encodings are tried in order on every key segment
+var base64Encodings = []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding}
+
+// decodeBase64Key decodes the "/"-separated segments of a key that are base64
+// encoded, for -decode-base64. A segment is only replaced when it decodes to
+// printable UTF-8 text. It reports whether any segment was decoded.
+func decodeBase64Key(key string) (string, bool) {
+	segments := strings.Split(key, "/")
+	decodedAny := false
+	for i, segment := range segments {
+		if decoded, ok := decodeBase64Segment(segment); ok {
+			segments[i] = decoded
+			decodedAny = true
+		}
+	}
+	return strings.Join(segments, "/"), decodedAny
+}
+
+// decodeBase64Segment decodes one key segment if it looks like base64 text
+func decodeBase64Segment(segment string) (string, bool) {
+	if len(segment) < minBase64Segment {
+		return "", false
+	}
+	for _, encoding := range base64Encodings {
+		data, err := encoding.DecodeString(segment)
+		if err != nil || len(data) == 0 || !utf8.Valid(data) {
+			continue
+		}
+		text := string(data)
+		if strings.IndexFunc(text, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+			continue
+		}
+		return text, true
+	}
+	return "", false
+}
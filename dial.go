@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dialContext is the signature of http.Transport.DialContext
+type dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+// newDialer returns a dialer that gives up connecting after -connect-timeout,
+// keeping the TCP keep-alive of http.DefaultTransport
+func newDialer() *net.Dialer {
+	return &net.Dialer{Timeout: *connectTimeout, KeepAlive: 30 * time.Second}
+}
+
+// restrictAddressFamily makes a dial function connect over IPv4 only with -4,
+// or IPv6 only with -6. By default both are tried, as by net.Dialer.
+func restrictAddressFamily(dial dialContext) dialContext {
+	suffix := "4"
+	if *ipv6Only {
+		suffix = "6"
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network == "tcp" || network == "udp" {
+			network += suffix
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// resolverDialContext returns a dial function that resolves host names with
+// the -dns-resolver: a DNS server as host[:port] (port 53 by default), or a
+// DNS-over-HTTPS endpoint with a JSON API, given as an https:// URL
+func resolverDialContext(resolver string) (dialContext, error) {
+	if strings.HasPrefix(resolver, "https://") {
+		u, err := url.Parse(resolver)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid DNS-over-HTTPS URL %q", resolver)
+		}
+		return dohDialContext(u.String()), nil
+	}
+
+	server := resolver
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid DNS server %q, expected host[:port]", resolver)
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid DNS server %q, expected an IP address", resolver)
+	}
+	if _, err := net.LookupPort("udp", port); err != nil {
+		return nil, fmt.Errorf("invalid DNS server port %q", port)
+	}
+
+	dialer := newDialer()
+	dialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return newDialer().DialContext(ctx, network, server)
+		},
+	}
+	return dialer.DialContext, nil
+}
+
+// dohClient sends the DNS-over-HTTPS queries. It uses the system resolver,
+// which is needed to reach the DoH server itself.
+var dohClient = &http.Client{Timeout: 10 * time.Second}
+
+// dohDialContext returns a dial function that resolves host names with
+// a DNS-over-HTTPS JSON API such as https://cloudflare-dns.com/dns-query
+func dohDialContext(endpoint string) dialContext {
+	dialer := newDialer()
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		var ips []string
+		if network != "tcp6" {
+			ips, err = dohLookup(ctx, endpoint, host, "A")
+		}
+		if network != "tcp4" {
+			more, err6 := dohLookup(ctx, endpoint, host, "AAAA")
+			ips = append(ips, more...)
+			if err == nil {
+				err = err6
+			}
+		}
+		if len(ips) == 0 {
+			if err == nil {
+				err = fmt.Errorf("no addresses found")
+			}
+			return nil, fmt.Errorf("resolving %s with %s: %v", host, endpoint, err)
+		}
+
+		var conn net.Conn
+		for _, ip := range ips {
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// dohLookup queries a DNS-over-HTTPS JSON API for the records of one type
+func dohLookup(ctx context.Context, endpoint, host, recordType string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	query := req.URL.Query()
+	query.Set("name", host)
+	query.Set("type", recordType)
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	var answer struct {
+		Status int `json:"Status"`
+		Answer []struct {
+			Type int    `json:"type"`
+			Data string `json:"data"`
+		} `json:"Answer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	for _, record := range answer.Answer {
+		// CNAME records are followed by the server and returned alongside the addresses
+		if net.ParseIP(record.Data) != nil && (record.Type == 1 || record.Type == 28) {
+			ips = append(ips, record.Data)
+		}
+	}
+	debugLog("Resolved %s %s with %s: %v", host, recordType, endpoint, ips)
+	return ips, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+)
+
+// keyChange is a key whose listing differs between the previous and the current run
+type keyChange struct {
+	object   s3Object
+	field    string // etag, last_modified or size
+	previous string
+	current  string
+}
+
+// listingDiff is the result of -diff: the keys added, removed and changed
+// since the previous report
+type listingDiff struct {
+	previousFile string
+	added        []s3Object
+	removed      []s3Object
+	changed      []keyChange
+	unchecked    []string // listed buckets whose listing is incomplete, so removals are unknown
+}
+
+// listingChanges is the -diff result of this run, or nil without -diff
+var listingChanges *listingDiff
+
+// diffListings compares the keys of a previous report with the current ones.
+// Keys of buckets that were not listed in this run are ignored. A key missing
+// now only counts as removed when its bucket was listed to the end; when the
+// current keys were read with -input-json, every bucket counts as complete.
+func diffListings(previousFile string, previous, current []s3Object, listings []bucketListing) *listingDiff {
+	diff := &listingDiff{previousFile: previousFile}
+	listed := make(map[string]bool)
+	complete := make(map[string]bool)
+	for _, listing := range listings {
+		listed[listing.URL] = true
+		complete[listing.URL] = (listing.Status == listingOK || listing.Status == listingEmpty) && !listing.Truncated
+	}
+	if len(listings) == 0 {
+		for _, object := range current {
+			listed[object.Bucket], complete[object.Bucket] = true, true
+		}
+	}
+
+	before := make(map[string]s3Object, len(previous))
+	for _, object := range previous {
+		before[object.url()] = object
+	}
+	now := make(map[string]bool, len(current))
+	for _, object := range current {
+		now[object.url()] = true
+		old, ok := before[object.url()]
+		if !ok {
+			diff.added = append(diff.added, object)
+		} else if change, changed := objectChange(old, object); changed {
+			diff.changed = append(diff.changed, change)
+		}
+	}
+
+	reported := make(map[string]bool)
+	for _, object := range previous {
+		if now[object.url()] || !listed[object.Bucket] {
+			continue
+		}
+		if !complete[object.Bucket] {
+			if !reported[object.Bucket] {
+				reported[object.Bucket] = true
+				diff.unchecked = append(diff.unchecked, object.Bucket)
+			}
+			continue
+		}
+		diff.removed = append(diff.removed, object)
+	}
+	return diff
+}
+
+// objectChange compares a key by its ETag, or by its LastModified or size
+// when the ETag is missing from either listing
+func objectChange(old, object s3Object) (keyChange, bool) {
+	change := keyChange{object: object}
+	switch {
+	case old.ETag != "" && object.ETag != "":
+		change.field, change.previous, change.current = "etag", old.ETag, object.ETag
+	case old.LastModified != "" && object.LastModified != "":
+		change.field, change.previous, change.current = "last_modified", old.LastModified, object.LastModified
+	case old.Size >= 0 && object.Size >= 0:
+		change.field, change.previous, change.current = "size", strconv.FormatInt(old.Size, 10), strconv.FormatInt(object.Size, 10)
+	}
+	return change, change.previous != change.current
+}
+
+// print writes the changed keys, followed by the totals
+func (d *listingDiff) print(w io.Writer) {
+	d.printKeys(w)
+	fmt.Fprintf(w, "Compared with %s: %s\n", d.previousFile, d.totals())
+}
+
+// totals returns the number of added, removed and changed keys
+func (d *listingDiff) totals() string {
+	return fmt.Sprintf("%d added, %d removed, %d changed", len(d.added), len(d.removed), len(d.changed))
+}
+
+// printKeys writes one line per key, + for added, - for removed and ~ for
+// changed keys
+func (d *listingDiff) printKeys(w io.Writer) {
+	for _, object := range d.added {
+		fmt.Fprintln(w, "+", object.displayKey())
+	}
+	for _, object := range d.removed {
+		fmt.Fprintln(w, "-", object.displayKey())
+	}
+	for _, change := range d.changed {
+		fmt.Fprintf(w, "~ %s (%s %s -> %s)\n", change.object.displayKey(), change.field, change.previous, change.current)
+	}
+	for _, bucketURL := range d.unchecked {
+		log.Printf("Not reporting removed keys of %s, its listing is incomplete (-l or a failed page)", bucketURL)
+	}
+}
+
+// jsonDiff is the -diff result in the JSON report
+type jsonDiff struct {
+	Previous string          `json:"previous"`
+	Added    []jsonObject    `json:"added"`
+	Removed  []jsonObject    `json:"removed"`
+	Changed  []jsonKeyChange `json:"changed"`
+}
+
+// jsonKeyChange is a changed key in the JSON report
+type jsonKeyChange struct {
+	Key      string `json:"key"`
+	URL      string `json:"url"`
+	Field    string `json:"field"`
+	Previous string `json:"previous"`
+	Current  string `json:"current"`
+}
+
+// newJSONDiff converts the -diff result for the JSON report, or returns nil without -diff
+func newJSONDiff(d *listingDiff) *jsonDiff {
+	if d == nil {
+		return nil
+	}
+	report := &jsonDiff{Previous: d.previousFile, Added: []jsonObject{}, Removed: []jsonObject{}, Changed: []jsonKeyChange{}}
+	for _, object := range d.added {
+		report.Added = append(report.Added, newJSONObject(object))
+	}
+	for _, object := range d.removed {
+		report.Removed = append(report.Removed, newJSONObject(object))
+	}
+	for _, change := range d.changed {
+		report.Changed = append(report.Changed, jsonKeyChange{
+			Key:      change.object.Key,
+			URL:      change.object.url(),
+			Field:    change.field,
+			Previous: change.previous,
+			Current:  change.current,
+		})
+	}
+	return report
+}
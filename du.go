@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// prefixUsage is the aggregated size of all objects below a prefix
+type prefixUsage struct {
+	prefix  string
+	size    int64 // total size of the keys of known size
+	count   int
+	unknown int // keys of unknown size, not part of size
+}
+
+// keyPrefix returns the first depth "/"-separated directories of a key.
+// Objects stored directly at that level are reported under ".".
+func keyPrefix(key string, depth int) string {
+	segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	dirs := segments[:len(segments)-1]
+	if len(dirs) > depth {
+		dirs = dirs[:depth]
+	}
+	if len(dirs) == 0 {
+		return "."
+	}
+	return strings.Join(dirs, "/") + "/"
+}
+
+// keyDepth returns the number of "/"-separated segments of a key, not counting
+// empty ones: readme.md is 1 deep, logs/2023/a.txt is 3 deep and the
+// directory marker logs/ is 1 deep
+func keyDepth(key string) int {
+	depth := 0
+	for _, segment := range strings.Split(key, "/") {
+		if segment != "" {
+			depth++
+		}
+	}
+	return depth
+}
+
+// diskUsage sums object sizes per prefix, sorted by descending size. Keys of
+// unknown size are counted apart. With -U the bucket URL is part of the
+// prefix so buckets are not merged.
+func diskUsage(objects []s3Object, depth int) []prefixUsage {
+	totals := make(map[string]*prefixUsage)
+	for _, object := range objects {
+		prefix := keyPrefix(object.Key, depth)
+		if *urlFileFlag != "" {
+			prefix = fmt.Sprintf("%s/%s", object.Bucket, prefix)
+		}
+		usage, ok := totals[prefix]
+		if !ok {
+			usage = &prefixUsage{prefix: prefix}
+			totals[prefix] = usage
+		}
+		if object.Size < 0 {
+			usage.unknown++
+		} else {
+			usage.size += object.Size
+		}
+		usage.count++
+	}
+
+	usages := make([]prefixUsage, 0, len(totals))
+	for _, usage := range totals {
+		usages = append(usages, *usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].size != usages[j].size {
+			return usages[i].size > usages[j].size
+		}
+		return usages[i].prefix < usages[j].prefix
+	})
+	return usages
+}
+
+// printDiskUsage prints the size of each prefix followed by a grand total,
+// like du, noting the keys of unknown size left out of the sizes
+func printDiskUsage(w io.Writer, objects []s3Object, depth int) {
+	total := prefixUsage{prefix: "total", count: len(objects)}
+	for _, usage := range diskUsage(objects, depth) {
+		printPrefixUsage(w, usage)
+		total.size += usage.size
+		total.unknown += usage.unknown
+	}
+	printPrefixUsage(w, total)
+}
+
+// printPrefixUsage prints one line of -du
+func printPrefixUsage(w io.Writer, usage prefixUsage) {
+	line := fmt.Sprintf("%10s  %6d  %s", formatBytes(usage.size), usage.count, usage.prefix)
+	if usage.unknown > 0 {
+		line += fmt.Sprintf(" (%d of unknown size)", usage.unknown)
+	}
+	fmt.Fprintln(w, line)
+}
+
+// formatBytes renders a byte count using binary (1024-based) units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an httptest server that answers ListObjects and GetObject for a
+// few path-style buckets
+type fakeS3 struct {
+	*httptest.Server
+	buckets map[string]map[string]string // bucket name -> key -> body
+
+	mu   sync.Mutex
+	gets []string // keys downloaded, as bucket/key
+}
+
+func newFakeS3(t *testing.T, buckets map[string]map[string]string) *fakeS3 {
+	t.Helper()
+	s := &fakeS3{buckets: buckets}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	if key == "" {
+		s.list(w, bucket, objects)
+		return
+	}
+	body, ok := objects[key]
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	s.gets = append(s.gets, bucket+"/"+key)
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, body)
+}
+
+// list writes a single-page ListBucketResult of a bucket, sorted like S3
+func (s *fakeS3) list(w http.ResponseWriter, bucket string, objects map[string]string) {
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix></Prefix><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>`, bucket)
+	for _, key := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>"%x"</ETag><LastModified>2024-01-02T03:04:05.000Z</LastModified></Contents>`,
+			key, len(objects[key]), len(objects[key]))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// setFlags sets command-line flags for one test and restores them afterwards
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("no flag -%s", name)
+		}
+		previous := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			t.Fatalf("-%s %s: %v", name, value, err)
+		}
+		t.Cleanup(func() { f.Value.Set(previous) })
+	}
+}
+
+// Lists two buckets from a -U file, downloads every key and writes the JSON
+// report, like: s3explorer -U buckets.txt -D -preserve-paths -json-out report.json
+func TestListDownloadReport(t *testing.T) {
+	server := newFakeS3(t, map[string]map[string]string{
+		"alpha": {"logs/a.txt": "first\n", "readme.md": "# alpha\n"},
+		"beta":  {"data/b.csv": "x,y\n1,2\n"},
+	})
+	t.Chdir(t.TempDir())
+	bucketsFile := "buckets.txt"
+	if err := os.WriteFile(bucketsFile, []byte(server.URL+"/alpha\n"+server.URL+"/beta\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]string{
+		"U":              bucketsFile,
+		"D":              "true",
+		"y":              "true",
+		"quiet":          "true",
+		"preserve-paths": "true",
+		"by-bucket":      "true",
+		"json-out":       "report.json",
+	})
+	defer func() { uniquePaths = nil }()
+
+	if code := run(); code != exitOK {
+		t.Fatalf("run returned %d", code)
+	}
+
+	for bucket, keys := range server.buckets {
+		for key, body := range keys {
+			matches, _ := filepath.Glob(filepath.Join("*", filepath.FromSlash(key)))
+			if len(matches) != 1 {
+				t.Errorf("%s/%s was saved %d times: %v", bucket, key, len(matches), matches)
+				continue
+			}
+			data, err := os.ReadFile(matches[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != body {
+				t.Errorf("%s holds %q, want %q", matches[0], data, body)
+			}
+		}
+	}
+	if len(server.gets) != 3 {
+		t.Errorf("got %d downloads, want 3: %v", len(server.gets), server.gets)
+	}
+
+	data, err := os.ReadFile("report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateReport(t, data)
+	var report jsonReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Buckets) != 2 || len(report.Objects) != 3 {
+		t.Fatalf("report has %d buckets and %d objects, want 2 and 3", len(report.Buckets), len(report.Objects))
+	}
+	for _, bucket := range report.Buckets {
+		if bucket.Status != string(listingOK) || bucket.KeyCount != len(server.buckets[bucket.Name]) {
+			t.Errorf("bucket %s has status %s and %d keys", bucket.URL, bucket.Status, bucket.KeyCount)
+		}
+	}
+	for _, object := range report.Objects {
+		if object.URL != object.BucketURL+"/"+object.Key || object.ContentType != "text/plain" {
+			t.Errorf("object %s has URL %s and content type %q", object.Key, object.URL, object.ContentType)
+		}
+	}
+}
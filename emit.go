@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// emitTools are the download commands -emit can print
+var emitTools = []string{"curl", "wget"}
+
+// printDownloadCommands prints one curl or wget command per object that saves
+// it to the same local path -D would use
+func printDownloadCommands(w io.Writer, tool string, objects []s3Object) {
+	assignUniquePaths(objects, renderLocalPath)
+	for _, object := range objects {
+		fmt.Fprintln(w, downloadCommand(tool, object, localPath(object)))
+	}
+}
+
+// downloadCommand returns the shell command that downloads an object to localFile
+func downloadCommand(tool string, object s3Object, localFile string) string {
+	target, source := shellQuote(filepath.ToSlash(localFile)), shellQuote(commandURL(object))
+	if tool == "wget" {
+		// wget -O does not create the directories of the output file
+		if dir := filepath.Dir(localFile); dir != "." {
+			return fmt.Sprintf("mkdir -p %s && wget -q -O %s %s", shellQuote(filepath.ToSlash(dir)), target, source)
+		}
+		return fmt.Sprintf("wget -q -O %s %s", target, source)
+	}
+	return fmt.Sprintf("curl -fsS --create-dirs -o %s %s", target, source)
+}
+
+// commandURL returns the URL of an object with its key percent-encoded, so
+// that characters such as spaces, # and ? in keys reach the server as part
+// of the path
+func commandURL(object s3Object) string {
+	segments := strings.Split(object.Key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	object.Key = strings.Join(segments, "/")
+	return object.url()
+}
+
+// shellQuote quotes a string for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Sentinel errors for the failures callers most often need to tell apart.
+// Errors returned for S3 responses wrap one of them when it applies, so they
+// can be matched with errors.Is; errors.As with *ResponseError gives the details.
+var (
+	ErrAccessDenied   = errors.New("access denied")
+	ErrNoSuchBucket   = errors.New("no such bucket")
+	ErrRegionRedirect = errors.New("bucket is in another region")
+	ErrNotXML         = errors.New("not an S3 XML response")
+)
+
+// ResponseError is an S3 error response: its status code and the fields of
+// its XML body, which are empty if the body was not an S3 error document
+type ResponseError struct {
+	URL        string
+	StatusCode int
+	S3Error
+}
+
+// newResponseError parses the body of an error response from url
+func newResponseError(url string, statusCode int, body []byte) *ResponseError {
+	e := &ResponseError{URL: url, StatusCode: statusCode}
+	if xml.Unmarshal(body, &e.S3Error) != nil {
+		e.S3Error = S3Error{}
+	}
+	return e
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("status %d", e.StatusCode)
+	}
+	if e.Code == "PermanentRedirect" && e.Endpoint != "" {
+		return fmt.Sprintf("%s, use endpoint %s", e.Code, e.Endpoint)
+	}
+	if e.Message == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Unwrap returns the sentinel error matching the S3 error code, or the status
+// code when the body carried none
+func (e *ResponseError) Unwrap() error {
+	switch e.Code {
+	case "AccessDenied", "AllAccessDisabled":
+		return ErrAccessDenied
+	case "NoSuchBucket":
+		return ErrNoSuchBucket
+	case "PermanentRedirect", "TemporaryRedirect", "AuthorizationHeaderMalformed", "IllegalLocationConstraintException":
+		return ErrRegionRedirect
+	}
+	switch e.StatusCode {
+	case http.StatusForbidden:
+		return ErrAccessDenied
+	case http.StatusMovedPermanently, http.StatusTemporaryRedirect:
+		return ErrRegionRedirect
+	}
+	return nil
+}
+
+// listingStatusOf classifies the error that ended a listing
+func listingStatusOf(err error) listingStatus {
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		return listingAccessDenied
+	case errors.Is(err, ErrNotXML):
+		return listingParseError
+	}
+	return listingFailed
+}
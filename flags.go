@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// newBoolAlias defines another name for a bool flag, which sets the same variable
+func newBoolAlias(name string, target *bool, usage string) *bool {
+	flag.BoolVar(target, name, *target, usage)
+	return target
+}
+
+// keyValueFlag is a repeatable flag of key=value pairs
+type keyValueFlag struct {
+	pairs [][2]string
+}
+
+// newKeyValueFlag defines a repeatable key=value flag, like flag.String does for a single value
+func newKeyValueFlag(name, usage string) *keyValueFlag {
+	f := &keyValueFlag{}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *keyValueFlag) String() string {
+	var parts []string
+	for _, pair := range f.pairs {
+		parts = append(parts, pair[0]+"="+pair[1])
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses and appends one key=value pair
+func (f *keyValueFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	f.pairs = append(f.pairs, [2]string{key, val})
+	return nil
+}
+
+// statusListFlag is a comma-separated list of HTTP status codes
+type statusListFlag struct {
+	codes map[int]bool
+	order []int
+}
+
+// newStatusListFlag defines a flag holding a list of HTTP status codes, starting with defaults
+func newStatusListFlag(name string, defaults []int, usage string) *statusListFlag {
+	f := &statusListFlag{codes: make(map[int]bool)}
+	for _, code := range defaults {
+		f.codes[code] = true
+		f.order = append(f.order, code)
+	}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *statusListFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, code := range f.order {
+		parts = append(parts, strconv.Itoa(code))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set replaces the list with the comma-separated codes in value
+func (f *statusListFlag) Set(value string) error {
+	codes := make(map[int]bool)
+	var order []int
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		code, err := strconv.Atoi(part)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("invalid HTTP status code %q", part)
+		}
+		if !codes[code] {
+			codes[code] = true
+			order = append(order, code)
+		}
+	}
+	f.codes, f.order = codes, order
+	return nil
+}
+
+// contains reports whether code is in the list
+func (f *statusListFlag) contains(code int) bool {
+	return f.codes[code]
+}
+
+// extensionMapFlag is a repeatable, comma-separated list of .from=.to
+// extension rewrites
+type extensionMapFlag struct {
+	rewrites [][2]string
+}
+
+// newExtensionMapFlag defines a flag holding extension rewrites
+func newExtensionMapFlag(name, usage string) *extensionMapFlag {
+	f := &extensionMapFlag{}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *extensionMapFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, rewrite := range f.rewrites {
+		parts = append(parts, rewrite[0]+"="+rewrite[1])
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses and appends the comma-separated .from=.to pairs in value
+func (f *extensionMapFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "=")
+		if !ok || !validExtension(from) || !validExtension(to) {
+			return fmt.Errorf("expected .from=.to, e.g. .bin=.jpg, got %q", part)
+		}
+		for _, rewrite := range f.rewrites {
+			if strings.EqualFold(rewrite[0], from) {
+				return fmt.Errorf("extension %s is mapped twice", from)
+			}
+		}
+		f.rewrites = append(f.rewrites, [2]string{from, to})
+	}
+	return nil
+}
+
+// validExtension reports whether ext is a dot followed by a name that can
+// end a file name, like .jpg or .tar.gz
+func validExtension(ext string) bool {
+	return len(ext) > 1 && ext[0] == '.' && ext[len(ext)-1] != '.' && !strings.ContainsAny(ext, `/\=`)
+}
+
+// rename returns name with the first mapped extension it ends with, matched
+// case-insensitively, replaced by its target
+func (f *extensionMapFlag) rename(name string) string {
+	for _, rewrite := range f.rewrites {
+		from, to := rewrite[0], rewrite[1]
+		if len(name) > len(from) && strings.EqualFold(name[len(name)-len(from):], from) {
+			return name[:len(name)-len(from)] + to
+		}
+	}
+	return name
+}
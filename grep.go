@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+const (
+	// grepMaxLine is the number of bytes of a line that -grep looks at; the
+	// rest of a longer line is skipped, which bounds the memory of each scan
+	grepMaxLine = 1 << 20
+	// grepMaxMatches is the number of matching lines kept per key
+	grepMaxMatches = 100
+	// grepExcerptLen is the length above which only the part of a line around
+	// the match is shown
+	grepExcerptLen = 200
+)
+
+// scanningBodies reports whether downloaded bodies are scanned, for -grep or -secrets
+func scanningBodies() bool {
+	return grepRegexp != nil || *secretsFlag
+}
+
+// grepRegexp is the compiled -grep pattern, or nil without -grep
+var grepRegexp *regexp.Regexp
+
+// grepMatch is a line of an object body that matches -grep
+type grepMatch struct {
+	Line int    `json:"line"`
+	Text string `json:"text"` // the line, or the part around the match of a long line
+}
+
+// grepResult holds the matches of -grep in one object
+type grepResult struct {
+	Matches []grepMatch `json:"matches"`
+	Count   int         `json:"count"`  // matching lines, including those beyond the ones kept
+	Binary  bool        `json:"binary"` // binary content, scanned up to its first match only
+}
+
+// grepResults records the matches of every scanned key by URL, for the
+// output and the JSON report
+var grepResults struct {
+	sync.Mutex
+	byURL map[string]*grepResult
+}
+
+// bodyScanner is an io.Writer that matches -grep and the -secrets rules
+// against the lines written to it, so downloads can be scanned as they are
+// saved. Content with a NUL byte in its first sniffLen bytes counts as binary.
+type bodyScanner struct {
+	line     []byte
+	lineNo   int
+	sniffed  int
+	result   grepResult
+	grepDone bool // binary content matched -grep, which looks no further
+	secrets  secretResult
+}
+
+// newBodyScanner returns a scanner for one object body, or nil without -grep
+// and -secrets
+func newBodyScanner() *bodyScanner {
+	if !scanningBodies() {
+		return nil
+	}
+	return &bodyScanner{grepDone: grepRegexp == nil}
+}
+
+// finished reports whether the rest of the body can be skipped
+func (s *bodyScanner) finished() bool {
+	return s.grepDone && !*secretsFlag
+}
+
+func (s *bodyScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.sniffed < sniffLen {
+		head := p[:min(len(p), sniffLen-s.sniffed)]
+		s.result.Binary = s.result.Binary || bytes.IndexByte(head, 0) >= 0
+		s.sniffed += len(head)
+	}
+	for len(p) > 0 && !s.finished() {
+		end := bytes.IndexByte(p, '\n')
+		chunk := p
+		if end >= 0 {
+			chunk = p[:end]
+		}
+		if room := grepMaxLine - len(s.line); room > 0 {
+			s.line = append(s.line, chunk[:min(len(chunk), room)]...)
+		}
+		if end < 0 {
+			break
+		}
+		s.matchLine()
+		p = p[end+1:]
+	}
+	return n, nil
+}
+
+// matchLine matches the buffered line and starts the next one
+func (s *bodyScanner) matchLine() {
+	s.lineNo++
+	line := bytes.TrimSuffix(s.line, []byte{'\r'})
+	s.line = s.line[:0]
+	if *secretsFlag {
+		s.secrets.matchLine(line, s.lineNo)
+	}
+	if s.grepDone {
+		return
+	}
+	loc := grepRegexp.FindIndex(line)
+	if loc == nil {
+		return
+	}
+	s.result.Count++
+	if s.result.Binary {
+		s.result.Matches = append(s.result.Matches, grepMatch{Line: s.lineNo})
+		s.grepDone = true
+		return
+	}
+	if len(s.result.Matches) < grepMaxMatches {
+		s.result.Matches = append(s.result.Matches, grepMatch{Line: s.lineNo, Text: grepExcerpt(line, loc)})
+	}
+}
+
+// record matches the last line, which has no newline, and keeps the results
+// of the object if anything matched
+func (s *bodyScanner) record(object s3Object) {
+	if s == nil {
+		return
+	}
+	if len(s.line) > 0 && !s.finished() {
+		s.matchLine()
+	}
+	s.secrets.record(object)
+	if s.result.Count == 0 {
+		return
+	}
+	grepResults.Lock()
+	defer grepResults.Unlock()
+	if grepResults.byURL == nil {
+		grepResults.byURL = make(map[string]*grepResult)
+	}
+	grepResults.byURL[object.url()] = &s.result
+}
+
+// grepExcerpt returns a matching line, or for a long line the part around the
+// match at loc, cut to whole UTF-8 characters
+func grepExcerpt(line []byte, loc []int) string {
+	if len(line) <= grepExcerptLen {
+		return strings.ToValidUTF8(string(line), "?")
+	}
+	around := max(0, (grepExcerptLen-(loc[1]-loc[0]))/2)
+	start, end := max(0, loc[0]-around), min(len(line), loc[1]+around)
+	end = min(end, start+grepExcerptLen)
+	excerpt := strings.ToValidUTF8(string(line[start:end]), "")
+	if start > 0 {
+		excerpt = "..." + excerpt
+	}
+	if end < len(line) {
+		excerpt += "..."
+	}
+	return excerpt
+}
+
+// objectMatches returns the -grep matches of an object, or nil if it was not
+// scanned or nothing matched
+func objectMatches(object s3Object) *grepResult {
+	grepResults.Lock()
+	defer grepResults.Unlock()
+	return grepResults.byURL[object.url()]
+}
+
+// scanBodies reads the body of every object and scans it for -grep and
+// -secrets without saving anything. Threads bodies are read at once, as many
+// from one host as downloads would be.
+func scanBodies(objects []s3Object, threads int) {
+	bar := pb.New(len(objects)).SetTemplate(keyProgressBar)
+	if *quiet {
+		bar.SetWriter(io.Discard)
+	}
+	bar.Start()
+
+	scheduler := newHostScheduler(objects, threads, perHostLimit(objects, threads))
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for {
+		object, ok := scheduler.take()
+		if !ok {
+			break
+		}
+		wg.Add(1)
+		go func(o s3Object) {
+			defer wg.Done()
+			defer scheduler.done(o)
+			defer bar.Increment()
+			switch {
+			case breaker.skip(o):
+			case scanBody(o):
+				breaker.success(o)
+			default:
+				breaker.failure(o)
+				failed.Add(1)
+			}
+		}(object)
+	}
+	wg.Wait()
+	bar.Finish()
+	breaker.report()
+
+	if n := failed.Load(); n > 0 {
+		log.Printf("Failed to read %d of %d keys to scan (use -debug for details)", n, len(objects))
+	}
+}
+
+// scanBody reads one object body through a bodyScanner and reports whether
+// it was read to the end
+func scanBody(object s3Object) bool {
+	url := object.url()
+	ctx, cancel, watch := newStallWatch(context.Background(), *stallTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		debugLog("Failed to read %s: %v", url, err)
+		return false
+	}
+	setAcceptEncoding(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		debugLog("Failed to read %s: %v", url, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		debugLog("Failed to read %s, status code: %d", url, resp.StatusCode)
+		return false
+	}
+
+	content, err := decompressedBody(object, resp, watch.reader(resp.Body))
+	if err != nil {
+		debugLog("Failed to decompress %s: %v", url, err)
+		return false
+	}
+	scanner := newBodyScanner()
+	if _, err := io.Copy(scanner, content); err != nil {
+		if watch.fired() {
+			err = fmt.Errorf("no data for %s (-stall-timeout)", *stallTimeout)
+		}
+		debugLog("Failed to read %s: %v", url, err)
+		return false
+	}
+	scanner.record(object)
+	return true
+}
+
+// printScanResults writes the -grep matches and the -secrets findings of the objects
+func printScanResults(w io.Writer, objects []s3Object) {
+	if grepRegexp != nil {
+		printGrepMatches(w, objects)
+	}
+	if *secretsFlag {
+		printSecretFindings(w, objects)
+	}
+}
+
+// printGrepMatches writes the matching lines of the objects, in their order,
+// as key:line: text, and logs the number of keys that matched
+func printGrepMatches(w io.Writer, objects []s3Object) {
+	matchedKeys := 0
+	for _, object := range objects {
+		result := objectMatches(object)
+		if result == nil {
+			continue
+		}
+		matchedKeys++
+		key := object.displayKey()
+		if result.Binary {
+			fmt.Fprintf(w, "%s:%d: binary content matches\n", key, result.Matches[0].Line)
+			continue
+		}
+		for _, match := range result.Matches {
+			fmt.Fprintf(w, "%s:%d: %s\n", key, match.Line, match.Text)
+		}
+		if more := result.Count - len(result.Matches); more > 0 {
+			fmt.Fprintf(w, "%s: %d more matching lines not shown\n", key, more)
+		}
+	}
+	log.Printf("-grep matched %d keys", matchedKeys)
+}
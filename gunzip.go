@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gzipKey reports whether an object's key names a gzip file, .gz or .tgz
+func gzipKey(key string) bool {
+	ext := strings.ToLower(filepath.Ext(key))
+	return ext == ".gz" || ext == ".tgz"
+}
+
+// gunzippedName returns the local name of a download decompressed by
+// -gunzip: without .gz, and with .tar for .tgz
+func gunzippedName(name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" || strings.HasSuffix(stem, "/") || strings.HasSuffix(stem, string(filepath.Separator)) {
+		return name // the whole name is the extension, like .gz
+	}
+	switch strings.ToLower(ext) {
+	case ".gz":
+		return stem
+	case ".tgz":
+		return stem + ".tar"
+	}
+	return name
+}
+
+// decompressedBody returns the content to save for a download: with -gunzip,
+// the decompressed body of a .gz or .tgz key or of a Content-Encoding: gzip
+// response, otherwise the body as it is. Bodies that do not start with the
+// gzip magic bytes are saved as they are, which includes responses the HTTP
+// client already decompressed.
+func decompressedBody(object s3Object, resp *http.Response, body io.Reader) (io.Reader, error) {
+	encoded := strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip")
+	if !*gunzip || !(encoded || gzipKey(object.Key)) {
+		return body, nil
+	}
+	buffered := bufio.NewReader(body)
+	if magic, _ := buffered.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		debugLog("Saving %s as it is, its content is not gzip-compressed (-gunzip)", object.url())
+		return buffered, nil
+	}
+	return gzip.NewReader(buffered)
+}
+
+// setAcceptEncoding asks for the object bytes exactly as stored with
+// -keep-compressed. Without it, the HTTP client asks for gzip and transparently
+// decompresses responses sent with Content-Encoding: gzip.
+func setAcceptEncoding(req *http.Request) {
+	if *keepCompressed {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// headResult is the cached outcome of a HEAD request
+type headResult struct {
+	StatusCode    int
+	ContentLength int64 // -1 when unknown
+	ContentType   string
+	LastModified  string
+	Header        http.Header
+}
+
+// headCache remembers HEAD results by URL so that features sharing a key
+// (size pre-pass, probes, downloads) do not request it more than once per run
+var headCache sync.Map // URL -> *headEntry
+
+// headEntry is the HEAD request of one URL. Callers that find it while the
+// request is in flight wait for done instead of sending their own.
+type headEntry struct {
+	done   chan struct{}
+	result headResult
+	err    error
+}
+
+// headObject returns the HEAD result for a URL, sending the request only once
+// even when several callers ask for it at the same time. A request that
+// failed is not cached, so a later call tries again.
+func headObject(url string) (headResult, error) {
+	entry := &headEntry{done: make(chan struct{})}
+	if existing, loaded := headCache.LoadOrStore(url, entry); loaded {
+		entry = existing.(*headEntry)
+		<-entry.done
+		return entry.result, entry.err
+	}
+	defer close(entry.done)
+
+	resp, err := httpClient.Head(url)
+	if err != nil {
+		entry.err = err
+		headCache.CompareAndDelete(url, entry)
+		return headResult{}, err
+	}
+	resp.Body.Close()
+
+	entry.result = headResult{
+		StatusCode:    resp.StatusCode,
+		ContentLength: resp.ContentLength,
+		ContentType:   resp.Header.Get("Content-Type"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+		Header:        resp.Header.Clone(),
+	}
+	return entry.result, nil
+}
+
+// cachedHead returns the HEAD result for a URL if it was already requested,
+// without waiting for a request still in flight
+func cachedHead(url string) (headResult, bool) {
+	cached, ok := headCache.Load(url)
+	if !ok {
+		return headResult{}, false
+	}
+	entry := cached.(*headEntry)
+	select {
+	case <-entry.done:
+		return entry.result, entry.err == nil
+	default:
+		return headResult{}, false
+	}
+}
+
+// headSizes fills in the size of objects whose listing did not provide one,
+// using at most threads concurrent HEAD requests. Sizes are stored on the
+// objects so the download does not need to request them again.
+func headSizes(objects []s3Object, threads int) {
+	sem := make(chan struct{}, threads)
+	var wg sync.WaitGroup
+	for i := range objects {
+		if objects[i].Size >= 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(o *s3Object) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			head, err := headObject(o.url())
+			if err != nil {
+				debugLog("Failed to HEAD %s: %v", o.url(), err)
+				return
+			}
+			if head.StatusCode != http.StatusOK {
+				debugLog("Failed to HEAD %s, status code: %d", o.url(), head.StatusCode)
+				return
+			}
+			if head.ContentLength >= 0 {
+				o.Size = head.ContentLength
+			}
+		}(&objects[i])
+	}
+	wg.Wait()
+}
+
+// totalSize sums the size of the objects. ok is false if any size is unknown.
+func totalSize(objects []s3Object) (total int64, ok bool) {
+	for _, object := range objects {
+		if object.Size < 0 {
+			return 0, false
+		}
+		total += object.Size
+	}
+	return total, true
+}
+
+// progressReader reports the number of bytes of every read to a callback
+type progressReader struct {
+	r        io.Reader
+	progress func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.progress(int64(n))
+	}
+	return n, err
+}
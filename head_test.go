@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Concurrent callers of the same URL share one HEAD request
+func TestHeadObjectConcurrent(t *testing.T) {
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heads.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Length", "42")
+	}))
+	defer server.Close()
+	url := server.URL + "/bucket/key"
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			head, err := headObject(url)
+			if err != nil || head.StatusCode != http.StatusOK || head.ContentLength != 42 {
+				t.Errorf("headObject = %+v, %v", head, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := heads.Load(); n != 1 {
+		t.Errorf("sent %d HEAD requests, want 1", n)
+	}
+	if head, ok := cachedHead(url); !ok || head.ContentLength != 42 {
+		t.Errorf("cachedHead = %+v, %v", head, ok)
+	}
+}
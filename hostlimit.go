@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+)
+
+// hostScheduler hands out downloads so that at most threads run at once and
+// at most perHost of them go to the same host. Each host has its own queue and
+// the queues are served round-robin, so a host at its cap does not hold up
+// the downloads waiting for other hosts.
+type hostScheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	hosts   []string // in order of first appearance
+	queues  map[string][]s3Object
+	active  map[string]int
+	next    int // index in hosts where the round-robin resumes
+	running int
+	pending int
+	threads int
+	perHost int
+}
+
+func newHostScheduler(objects []s3Object, threads, perHost int) *hostScheduler {
+	s := &hostScheduler{
+		queues:  make(map[string][]s3Object),
+		active:  make(map[string]int),
+		pending: len(objects),
+		threads: threads,
+		perHost: perHost,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for _, object := range objects {
+		host := objectHost(object)
+		if _, ok := s.queues[host]; !ok {
+			s.hosts = append(s.hosts, host)
+		}
+		s.queues[host] = append(s.queues[host], object)
+	}
+	return s
+}
+
+// take blocks until a queued object may start and returns it, or returns
+// false once every object was handed out. Each object taken must be
+// released with done.
+func (s *hostScheduler) take() (s3Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.pending > 0 {
+		if s.running < s.threads {
+			for i := range s.hosts {
+				host := s.hosts[(s.next+i)%len(s.hosts)]
+				if len(s.queues[host]) == 0 || s.active[host] >= s.perHost {
+					continue
+				}
+				object := s.queues[host][0]
+				s.queues[host] = s.queues[host][1:]
+				s.active[host]++
+				s.running++
+				s.pending--
+				s.next = (s.next + i + 1) % len(s.hosts)
+				return object, true
+			}
+		}
+		s.cond.Wait()
+	}
+	return s3Object{}, false
+}
+
+// done releases the slots of an object returned by take
+func (s *hostScheduler) done(object s3Object) {
+	s.mu.Lock()
+	s.active[objectHost(object)]--
+	s.running--
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// remaining returns the number of objects not handed out yet
+func (s *hostScheduler) remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// perHostLimit returns -concurrency-per-host, or by default half of threads
+// (rounded up) when the objects come from several hosts and threads otherwise
+func perHostLimit(objects []s3Object, threads int) int {
+	if *concurrencyPerHost > 0 {
+		return min(*concurrencyPerHost, threads)
+	}
+	for _, object := range objects {
+		if objectHost(object) != objectHost(objects[0]) {
+			return (threads + 1) / 2
+		}
+	}
+	return threads
+}
+
+// objectHost returns the host an object is downloaded from
+func objectHost(object s3Object) string {
+	u, err := url.Parse(object.url())
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
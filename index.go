@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseIndexList parses the -d value 3,7,12 or 2-5 into 1-based indices
+// that must lie between 1 and count. ok is false when spec is not made of
+// numbers and ranges only, so it is a key name.
+func parseIndexList(spec string, count int) (indices []int, ok bool, err error) {
+	for _, part := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, false, nil
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil {
+				return nil, false, nil
+			}
+		}
+		if from < 1 || to < from {
+			return nil, true, fmt.Errorf("invalid index %q in -d", strings.TrimSpace(part))
+		}
+		if to > count {
+			return nil, true, fmt.Errorf("index %d in -d is out of range, the listing has %d keys", to, count)
+		}
+		for i := from; i <= to; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, true, nil
+}
+
+// selectByIndex returns the listed objects picked by index with -d, in the
+// order given and without duplicates, or false if the -d value names a key.
+// A key that is literally named like an index list, such as 2023, is taken
+// as the key. So is a value that is no valid index list for the listing, such
+// as 2023-01, when -u names the bucket the key can be fetched from unlisted.
+func selectByIndex(matched, objects []s3Object, spec string) ([]s3Object, bool, error) {
+	if _, found := findObject(objects, spec); found {
+		return nil, false, nil
+	}
+	indices, ok, err := parseIndexList(spec, len(matched))
+	if err != nil && *urlFlag != "" {
+		debugLog("-d %s is not an index list for this listing (%v), downloading it as a key", spec, err)
+		return nil, false, nil
+	}
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	seen := make(map[int]bool)
+	var selected []s3Object
+	for _, i := range indices {
+		if !seen[i] {
+			seen[i] = true
+			selected = append(selected, matched[i-1])
+		}
+	}
+	return selected, true, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestSelectByIndex(t *testing.T) {
+	defer func(url string) { *urlFlag = url }(*urlFlag)
+	objects := []s3Object{{Key: "a"}, {Key: "b"}, {Key: "c"}, {Key: "2023"}}
+	tests := []struct {
+		name, url, spec string
+		want            []string
+		byIndex         bool
+		err             bool
+	}{
+		{name: "list and range", spec: "3,1-2,1", want: []string{"c", "a", "b"}, byIndex: true},
+		{name: "listed key named like an index", spec: "2023"},
+		{name: "key name", spec: "logs/a.txt"},
+		{name: "out of range", spec: "7", byIndex: true, err: true},
+		{name: "reversed range", spec: "2023-01", byIndex: true, err: true},
+		{name: "out of range with -u", url: "http://bucket.test", spec: "7"},
+		{name: "unlisted date-like key with -u", url: "http://bucket.test", spec: "2023-01"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*urlFlag = test.url
+			selected, byIndex, err := selectByIndex(objects, objects, test.spec)
+			if (err != nil) != test.err || byIndex != test.byIndex {
+				t.Fatalf("selectByIndex(%q) = %v, %v, want by index %v, error %v", test.spec, byIndex, err, test.byIndex, test.err)
+			}
+			var keys []string
+			for _, object := range selected {
+				keys = append(keys, object.Key)
+			}
+			if !slices.Equal(keys, test.want) {
+				t.Errorf("selectByIndex(%q) picked %v, want %v", test.spec, keys, test.want)
+			}
+		})
+	}
+}
+
+// A key named like a reversed index range that is beyond -l is fetched from
+// the -u bucket, like: s3explorer -u http://host/alpha -l 1 -d 2023-01
+func TestDownloadUnlistedIndexLikeKey(t *testing.T) {
+	server := newFakeS3(t, map[string]map[string]string{
+		"alpha": {"0-first.txt": "first\n", "2023-01": "january\n"},
+	})
+	t.Chdir(t.TempDir())
+	setFlags(t, map[string]string{
+		"u":     server.URL + "/alpha",
+		"l":     "1",
+		"d":     "2023-01",
+		"quiet": "true",
+	})
+	defer func() { uniquePaths = nil }()
+
+	if code := run(); code != exitOK {
+		t.Fatalf("run returned %d", code)
+	}
+	data, err := os.ReadFile("2023-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "january\n" {
+		t.Errorf("2023-01 holds %q", data)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// inputEntry is one element of -input-json: a key or URL string, or an object
+// of the -json report with a key and/or url field
+type inputEntry struct {
+	Key          string `json:"key"`
+	URL          string `json:"url"`
+	Size         *int64 `json:"size"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// UnmarshalJSON accepts both a plain string and an object
+func (e *inputEntry) UnmarshalJSON(data []byte) error {
+	switch {
+	case bytes.HasPrefix(data, []byte(`"`)):
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if strings.Contains(s, "://") {
+			e.URL = s
+		} else {
+			e.Key = s
+		}
+		return nil
+	case bytes.HasPrefix(data, []byte("{")):
+		type plain inputEntry
+		return json.Unmarshal(data, (*plain)(e))
+	}
+	return fmt.Errorf("expected a key, URL or object, got %s", data)
+}
+
+// readInputJSON reads the objects to work on from a JSON file, or stdin for
+// "-". The file is either an array of entries or a -json report, whose
+// objects are used, in bucket URL order for a -json-by-bucket report. Keys
+// without a URL belong to the bucket given with -u.
+func readInputJSON(filename string) ([]s3Object, error) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []inputEntry
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var report struct {
+			Objects  *[]inputEntry `json:"objects"`
+			ByBucket map[string]struct {
+				Objects []inputEntry `json:"objects"`
+			} `json:"by_bucket"` // -json-by-bucket report
+		}
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, fmt.Errorf("invalid JSON in %s: %v", filename, err)
+		}
+		switch {
+		case report.Objects != nil:
+			entries = *report.Objects
+		case report.ByBucket != nil:
+			for _, bucket := range slices.Sorted(maps.Keys(report.ByBucket)) {
+				entries = append(entries, report.ByBucket[bucket].Objects...)
+			}
+		default:
+			return nil, fmt.Errorf("%s is an object without an \"objects\" array or \"by_bucket\" object", filename)
+		}
+	} else if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s, expected an array of keys, URLs or objects: %v", filename, err)
+	}
+
+	objects := make([]s3Object, 0, len(entries))
+	for i, entry := range entries {
+		object, err := entry.object()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d of %s: %v", i, filename, err)
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// object turns an entry into an s3Object. With both a key and a URL, the
+// bucket URL is what precedes the key in the URL.
+func (e inputEntry) object() (s3Object, error) {
+	var object s3Object
+	switch {
+	case e.URL != "" && e.Key != "" && strings.HasSuffix(e.URL, "/"+e.Key):
+		object = s3Object{Bucket: strings.TrimSuffix(e.URL, "/"+e.Key), Key: e.Key}
+	case e.URL != "":
+		var err error
+		if object, err = objectFromURL(e.URL); err != nil {
+			return s3Object{}, fmt.Errorf("invalid url %q: %v", e.URL, err)
+		}
+	case e.Key != "":
+		if *urlFlag == "" {
+			return s3Object{}, fmt.Errorf("key %q has no url, and -u is not set", e.Key)
+		}
+		object = s3Object{Bucket: *urlFlag, Key: e.Key}
+	default:
+		return s3Object{}, fmt.Errorf("neither a key nor a url")
+	}
+	object.ETag, object.LastModified = e.ETag, e.LastModified
+	object.Size = -1
+	if e.Size != nil {
+		object.Size = *e.Size
+	}
+	return object, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// listingCache stores listing responses on disk for -list-cache, one JSON
+// file per page. Entries are keyed by the page URL, which includes the
+// prefix, pagination token and -list-param parameters, and by the access key
+// the requests are signed with.
+type listingCache struct {
+	dir      string
+	ttl      time.Duration
+	identity string
+}
+
+// cachedPage is a listing response stored by -list-cache
+type cachedPage struct {
+	URL         string    `json:"url"`
+	FetchedAt   time.Time `json:"fetched_at"`
+	ContentType string    `json:"content_type"`
+	ETag        string    `json:"etag,omitempty"`
+	Body        []byte    `json:"body"`
+}
+
+// listCache is the -list-cache, or nil without it
+var listCache *listingCache
+
+// openListCache creates the cache directory
+func openListCache(dir string, ttl time.Duration) (*listingCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	cache := &listingCache{dir: dir, ttl: ttl}
+	if creds, ok := resolveCredentials(); ok {
+		cache.identity = creds.AccessKey
+	}
+	return cache, nil
+}
+
+func (c *listingCache) path(pageURL string) string {
+	sum := sha256.Sum256([]byte(c.identity + "\n" + pageURL))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// load returns the cached response for a page if it is younger than the TTL.
+// With -refresh nothing is served from the cache.
+func (c *listingCache) load(pageURL string) (cachedPage, bool) {
+	var page cachedPage
+	if c == nil || *refreshCache {
+		return page, false
+	}
+	data, err := os.ReadFile(c.path(pageURL))
+	if err != nil {
+		return page, false
+	}
+	if err := json.Unmarshal(data, &page); err != nil || page.URL != pageURL {
+		debugLog("Ignoring invalid -list-cache entry for %s", pageURL)
+		return page, false
+	}
+	if c.ttl > 0 && time.Since(page.FetchedAt) > c.ttl {
+		return page, false
+	}
+	return page, true
+}
+
+// store writes a listing response to the cache. Failures only cost a request
+// on the next run, so they are not reported outside -debug.
+func (c *listingCache) store(page cachedPage) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(page)
+	if err != nil {
+		return
+	}
+	path := c.path(page.URL)
+	temp, err := os.CreateTemp(c.dir, ".page-*")
+	if err != nil {
+		debugLog("Failed to cache the listing of %s: %v", page.URL, err)
+		return
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		debugLog("Failed to cache the listing of %s: %v", page.URL, err)
+		os.Remove(temp.Name())
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XML structure for parsing S3 ListBucket result. The tags name elements by
+// local name only, which encoding/xml matches in any namespace: AWS's default
+// xmlns, no namespace at all and prefixed elements (<s3:Contents>) used by some
+// S3-compatible providers all parse the same. Keep new tags namespace-free.
+type ListBucketResult struct {
+	Name       string `xml:"Name"`
+	Prefix     string `xml:"Prefix"`
+	Marker     string `xml:"Marker"`
+	NextMarker string `xml:"NextMarker"`
+
+	// ListObjectsV2 (list-type=2) pagination
+	ContinuationToken     string `xml:"ContinuationToken"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	StartAfter            string `xml:"StartAfter"`
+
+	MaxKeys     int  `xml:"MaxKeys"`
+	KeyCount    int  `xml:"KeyCount"`
+	IsTruncated bool `xml:"IsTruncated"`
+	Contents    []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		ETag         string `xml:"ETag"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// S3Error is the XML body S3 returns with error responses
+type S3Error struct {
+	Code     string `xml:"Code"`
+	Message  string `xml:"Message"`
+	Bucket   string `xml:"Bucket"`
+	Endpoint string `xml:"Endpoint"`
+}
+
+// listingStatus tells apart the ways listing a bucket can end
+type listingStatus string
+
+const (
+	listingOK           listingStatus = "ok"            // listed, with at least one key
+	listingEmpty        listingStatus = "empty"         // listed successfully, no keys
+	listingAccessDenied listingStatus = "access_denied" // 403 / AccessDenied
+	listingParseError   listingStatus = "parse_error"   // the response was not a valid S3 listing
+	listingFailed       listingStatus = "failed"        // network errors and other status codes
+	listingUnchanged    listingStatus = "unchanged"     // 304 to the ETag recorded in -state
+)
+
+// failed reports whether the bucket could not be listed
+func (s listingStatus) failed() bool {
+	return s != listingOK && s != listingEmpty && s != listingUnchanged
+}
+
+// bucketListing is the outcome of listing a single bucket URL
+type bucketListing struct {
+	URL        string
+	ListPrefix string // prefix requested with -prefixes-file, if any
+	Status     listingStatus
+	Name       string // bucket name reported by the listing
+	Prefix     string // prefix the listing was restricted to
+	MaxKeys    int    // page size reported by the listing
+	KeyCount   int    // keys returned across all pages, before -l is applied
+	Pages      int
+	Truncated  bool // more keys were available than were listed
+	Objects    []s3Object
+	Referrals  []string             // other bucket URLs referenced by the response, for -follow
+	ETags      map[string]string    // first page URL -> ETag of the response, for -state
+	Positions  map[string]pageToken // list prefix -> token of the first key not listed, zero if listed to the end, for -state
+	Err        error                // why the listing failed, see errors.go
+	messages   *messageBuffer       // log of a concurrent listing, printed in order by listPrefixes
+}
+
+// fail records the error that ended the listing and the status it maps to
+func (l *bucketListing) fail(err error) {
+	l.Err = err
+	l.Status = listingStatusOf(err)
+}
+
+// pageToken is the query parameter that selects the next page of a listing:
+// marker for ListObjects (v1), continuation-token or start-after for v2.
+// The zero value selects the first page.
+type pageToken struct {
+	param string
+	value string
+}
+
+// listBucket fetches S3 keys from a bucket URL and parses XML response, following
+// pagination tokens until limit keys were listed or the bucket is exhausted.
+// If XML parsing fails, logs the error and skips to the next URL if -U is set.
+func listBucket(bucketURL, prefix string, limit int, messages *messageBuffer) bucketListing {
+	listing := bucketListing{URL: bucketURL, ListPrefix: prefix, messages: messages}
+	token := startToken()
+	resumed := false
+	if saved, ok := state.listingPosition(bucketURL, prefix); ok {
+		listing.messages.printf("Resuming the listing of %s where an earlier run stopped (%s=%s)", bucketURL, saved.param, saved.value)
+		token, resumed = saved, true
+	}
+	// next is where the listing stopped, if it did before the end
+	var next pageToken
+	for len(listing.Objects) < limit {
+		result, ok := listPage(&listing, token)
+		if !ok {
+			if listing.Pages > 0 || resumed {
+				next = token
+			}
+			break
+		}
+		listing.Pages++
+		listProgress.page(len(result.Contents))
+		listing.Name = result.Name
+		listing.Prefix = result.Prefix
+		listing.MaxKeys = result.MaxKeys
+		listing.KeyCount += len(result.Contents)
+
+		// Extract keys up to the specified limit
+		for _, content := range result.Contents {
+			if len(listing.Objects) >= limit {
+				listing.Truncated = true
+				next = afterKeyToken(listing.Objects[len(listing.Objects)-1].Key)
+				break
+			}
+			listing.Objects = append(listing.Objects, s3Object{Bucket: bucketURL, Key: content.Key, Size: content.Size,
+				ETag: content.ETag, LastModified: content.LastModified})
+		}
+
+		if listing.Truncated {
+			break
+		}
+		following, more := nextPage(result)
+		if !more || following == token {
+			break
+		}
+		if len(listing.Objects) >= limit {
+			listing.Truncated = true
+			next = following
+			break
+		}
+		token = following
+	}
+	if resumed {
+		// The ETag of a later page says nothing about the bucket as a whole
+		listing.ETags = nil
+	}
+	if listing.Status != listingUnchanged && (listing.Pages > 0 || next != (pageToken{})) {
+		listing.Positions = map[string]pageToken{prefix: next}
+	}
+
+	if listing.Status == "" {
+		listing.Status = listingOK
+		if listing.KeyCount == 0 {
+			listing.Status = listingEmpty
+		}
+	}
+
+	listing.messages.debugf("Listed %s: bucket %q, prefix %q, %d keys in %d pages (max-keys %d, truncated %v)",
+		bucketURL, listing.Name, listing.Prefix, len(listing.Objects), listing.Pages, listing.MaxKeys, listing.Truncated)
+	return listing
+}
+
+// startToken returns the token of the first page: the -start-after key as
+// start-after for ListObjectsV2 or as marker for v1, or the zero token
+func startToken() pageToken {
+	if *startAfter == "" {
+		return pageToken{}
+	}
+	if *listVersion == 2 {
+		return pageToken{"start-after", *startAfter}
+	}
+	return pageToken{"marker", *startAfter}
+}
+
+// afterKeyToken returns the token of a page starting after key, for listings
+// cut off by -l in the middle of a page
+func afterKeyToken(key string) pageToken {
+	if *listVersion == 2 {
+		return pageToken{"start-after", key}
+	}
+	return pageToken{"marker", key}
+}
+
+// nextPage returns the token of the next page, or false if the listing is complete.
+// Some S3-compatible stores omit IsTruncated, so a full page (KeyCount or the
+// number of keys equal to MaxKeys) is also taken as a sign there is more to fetch.
+func nextPage(result ListBucketResult) (pageToken, bool) {
+	if len(result.Contents) == 0 {
+		return pageToken{}, false
+	}
+	count := result.KeyCount
+	if count == 0 {
+		count = len(result.Contents)
+	}
+	if !result.IsTruncated && (result.MaxKeys == 0 || count < result.MaxKeys) {
+		return pageToken{}, false
+	}
+
+	lastKey := result.Contents[len(result.Contents)-1].Key
+	if *listVersion == 2 {
+		if result.NextContinuationToken != "" {
+			return pageToken{"continuation-token", result.NextContinuationToken}, true
+		}
+		// A v2 response always carries KeyCount; without it the endpoint
+		// ignored list-type=2 and answered with a v1 listing
+		if result.KeyCount > 0 {
+			return pageToken{"start-after", lastKey}, true
+		}
+		debugLog("Endpoint answered list-type=2 with a v1 listing, paginating with marker")
+	}
+	if result.NextMarker != "" {
+		return pageToken{"marker", result.NextMarker}, true
+	}
+	return pageToken{"marker", lastKey}, true
+}
+
+// listPrefixes lists every prefix of a bucket concurrently, at most -lt at a
+// time, and merges the listings into one. Keys returned for several prefixes
+// are only kept once and -l applies to each prefix. The merged listing
+// succeeds if any prefix could be listed. With -ordered, the messages of each
+// prefix are printed once all are listed, in the order of the prefixes.
+func listPrefixes(bucketURL string, prefixes []string, limit int) bucketListing {
+	results := make([]bucketListing, len(prefixes))
+	semaphore := make(chan struct{}, *listThreads)
+	var wg sync.WaitGroup
+	for i, prefix := range prefixes {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, prefix string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i] = listBucket(bucketURL, prefix, limit, newMessageBuffer())
+		}(i, prefix)
+	}
+	wg.Wait()
+
+	merged := bucketListing{URL: bucketURL}
+	seenKeys := make(map[string]bool)
+	seenReferrals := make(map[string]bool)
+	for _, result := range results {
+		result.messages.flush()
+		if result.Status.failed() {
+			debugLog("Failed to list prefix %q of %s: %s", result.ListPrefix, bucketURL, result.Status)
+			if merged.Status == "" {
+				merged.Status, merged.Err = result.Status, result.Err
+			}
+		} else if merged.Name == "" {
+			merged.Name = result.Name
+			merged.MaxKeys = result.MaxKeys
+		}
+		// ok wins over empty, empty over unchanged and unchanged over failures
+		if result.Status == listingOK || (!result.Status.failed() && merged.Status.failed()) ||
+			(result.Status == listingEmpty && merged.Status == listingUnchanged) {
+			merged.Status, merged.Err = result.Status, nil
+		}
+		for listPrefix, next := range result.Positions {
+			if merged.Positions == nil {
+				merged.Positions = make(map[string]pageToken)
+			}
+			merged.Positions[listPrefix] = next
+		}
+		for pageURL, etag := range result.ETags {
+			if merged.ETags == nil {
+				merged.ETags = make(map[string]string)
+			}
+			merged.ETags[pageURL] = etag
+		}
+		merged.KeyCount += result.KeyCount
+		merged.Pages += result.Pages
+		merged.Truncated = merged.Truncated || result.Truncated
+		for _, object := range result.Objects {
+			if !seenKeys[object.Key] {
+				seenKeys[object.Key] = true
+				merged.Objects = append(merged.Objects, object)
+			}
+		}
+		for _, referral := range result.Referrals {
+			if !seenReferrals[referral] {
+				seenReferrals[referral] = true
+				merged.Referrals = append(merged.Referrals, referral)
+			}
+		}
+	}
+	return merged
+}
+
+// listPage requests the page of the listing selected by token.
+// Failures set the status of the listing; failures of the first page also
+// record the referrals of the error response.
+func listPage(listing *bucketListing, token pageToken) (ListBucketResult, bool) {
+	var result ListBucketResult
+	pageURL, err := listURL(listing.URL, listing.ListPrefix, token)
+	if err != nil {
+		listing.messages.debugf("Invalid bucket URL %s: %v", listing.URL, err)
+		listing.fail(err)
+		return result, false
+	}
+
+	if page, ok := listCache.load(pageURL); ok {
+		listing.messages.debugf("Using the listing of %s cached at %s", pageURL, page.FetchedAt.Format(time.RFC3339))
+		return parseListPage(listing, pageURL, page.ContentType, page.ETag, page.Body)
+	}
+
+	req, err := newListRequest(pageURL)
+	if err != nil {
+		listing.messages.debugf("Invalid bucket URL %s: %v", listing.URL, err)
+		listing.fail(err)
+		return result, false
+	}
+	// The first page of a bucket completed in an earlier -state run is requested
+	// conditionally: a 304 means the bucket did not change since
+	etag := ""
+	if listing.Pages == 0 {
+		etag = state.listingETag(listing.URL, pageURL)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		listing.messages.debugf("Failed to retrieve keys from %s: %v", pageURL, err)
+		listing.fail(err)
+		return result, false
+	}
+	defer resp.Body.Close()
+
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		listing.messages.printf("%s is unchanged since the last run, skipping it", pageURL)
+		listing.Status = listingUnchanged
+		return result, false
+	}
+
+	// Read and parse the XML response to retrieve keys
+	rawData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		listing.messages.debugf("Error reading response body from %s: %v", pageURL, err)
+		listing.fail(err)
+		return result, false
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		respErr := newResponseError(pageURL, resp.StatusCode, rawData)
+		if respErr.Code != "" {
+			listing.messages.debugf("Failed to retrieve keys from %s, status code: %d (%v)", pageURL, resp.StatusCode, respErr)
+		} else {
+			listing.messages.debugf("Failed to retrieve keys from %s, status code: %d", pageURL, resp.StatusCode)
+		}
+		listing.fail(respErr)
+		if listing.Pages == 0 {
+			listing.Referrals = errorReferrals(listing.URL, rawData)
+		}
+		return result, false
+	}
+
+	contentType, responseETag := resp.Header.Get("Content-Type"), resp.Header.Get("ETag")
+	result, ok := parseListPage(listing, pageURL, contentType, responseETag, rawData)
+	if ok {
+		listCache.store(cachedPage{URL: pageURL, FetchedAt: time.Now(), ContentType: contentType, ETag: responseETag, Body: rawData})
+	}
+	return result, ok
+}
+
+// parseListPage parses a 200 response to a listing request, from the server
+// or from -list-cache
+func parseListPage(listing *bucketListing, pageURL, contentType, etag string, rawData []byte) (ListBucketResult, bool) {
+	var result ListBucketResult
+	// An HTML page (captive portal, CDN error) served with 200 would otherwise
+	// unmarshal into an empty result and look like an empty bucket
+	if !isListingResponse(contentType, rawData) {
+		listing.messages.printf("%s did not return an S3 listing (Content-Type %q), skipping it", pageURL, contentType)
+		listing.fail(fmt.Errorf("%w: Content-Type %q", ErrNotXML, contentType))
+		return result, false
+	}
+
+	if err := xml.Unmarshal(rawData, &result); err != nil {
+		listing.messages.debugf("Error parsing XML from %s: %v. Skipping to the next URL.", pageURL, err)
+		listing.fail(fmt.Errorf("%w: %v", ErrNotXML, err))
+		return result, false
+	}
+	if listing.Pages == 0 && etag != "" {
+		listing.ETags = map[string]string{pageURL: etag}
+	}
+	return result, true
+}
+
+// newListRequest builds the request for a listing page: a GET of the page URL,
+// or with -list-method POST a POST of the URL without its query, which is sent
+// as a form in the body instead
+func newListRequest(pageURL string) (*http.Request, error) {
+	if *listMethod != http.MethodPost {
+		return http.NewRequest(http.MethodGet, pageURL, nil)
+	}
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	form := u.RawQuery
+	u.RawQuery = ""
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(form))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// isListingResponse reports whether a response body looks like an S3 ListBucketResult
+func isListingResponse(contentType string, body []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		return false
+	}
+	return bytes.Contains(body, []byte("ListBucketResult"))
+}
+
+// listURL returns the listing URL of a bucket: the query of the bucket URL,
+// followed by list-type=2 with -list-version 2, the -list-param parameters,
+// the prefix and the pagination token
+func listURL(bucketURL, prefix string, token pageToken) (string, error) {
+	if token == (pageToken{}) && len(listParams.pairs) == 0 && *listVersion != 2 && prefix == "" {
+		return bucketURL, nil
+	}
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if *listVersion == 2 {
+		query.Set("list-type", "2")
+	}
+	for _, pair := range listParams.pairs {
+		query.Set(pair[0], pair[1])
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if token.param != "" {
+		query.Set(token.param, token.value)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// printListingSummary prints the buckets that could not be listed and, when
+// several buckets were listed, a count per status. It reports whether any failed.
+func printListingSummary(w io.Writer, listings []bucketListing) bool {
+	counts := make(map[listingStatus]int)
+	failed := false
+	for _, listing := range listings {
+		counts[listing.Status]++
+		if listing.Status.failed() {
+			failed = true
+			detail := strings.ReplaceAll(string(listing.Status), "_", " ")
+			if listing.Err != nil && !errors.Is(listing.Err, ErrAccessDenied) {
+				detail += " (" + listing.Err.Error() + ")"
+			}
+			fmt.Fprintf(w, "Failed to list %s: %s\n", listing.URL, detail)
+		}
+	}
+	if len(listings) > 1 || failed {
+		var parts []string
+		for _, status := range []listingStatus{listingOK, listingEmpty, listingUnchanged, listingAccessDenied, listingParseError, listingFailed} {
+			if counts[status] > 0 {
+				parts = append(parts, fmt.Sprintf("%d %s", counts[status], strings.ReplaceAll(string(status), "_", " ")))
+			}
+		}
+		fmt.Fprintf(w, "Buckets: %s\n", strings.Join(parts, ", "))
+	}
+	return failed
+}
+
+// errorReferrals returns the bucket URLs that an S3 error response points to,
+// such as the <Endpoint> of a PermanentRedirect for a bucket in another region
+func errorReferrals(bucketURL string, body []byte) []string {
+	var s3Err S3Error
+	if err := xml.Unmarshal(body, &s3Err); err != nil || s3Err.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil
+	}
+	debugLog("%s responded with %s, endpoint %s", bucketURL, s3Err.Code, s3Err.Endpoint)
+
+	// Virtual-hosted endpoints already name the bucket; path-style URLs keep their path
+	referral := fmt.Sprintf("%s://%s", u.Scheme, s3Err.Endpoint)
+	if s3Err.Bucket == "" || !strings.HasPrefix(s3Err.Endpoint, s3Err.Bucket+".") {
+		referral += strings.TrimSuffix(u.Path, "/")
+	}
+	if referral == strings.TrimSuffix(bucketURL, "/") {
+		return nil
+	}
+	return []string{referral}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFixture returns the content of a file in testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// The same listing with AWS's default namespace, without a namespace and
+// with prefixed elements, as sent by some S3-compatible providers
+func TestParseListPageNamespaces(t *testing.T) {
+	for _, fixture := range []string{"listing-default-ns.xml", "listing-no-ns.xml", "listing-prefixed-ns.xml"} {
+		t.Run(fixture, func(t *testing.T) {
+			listing := bucketListing{URL: "http://bucket.test/"}
+			result, ok := parseListPage(&listing, listing.URL, "application/xml", "", readFixture(t, fixture))
+			if !ok {
+				t.Fatalf("not parsed: %v", listing.Err)
+			}
+			if result.Name != "example" || result.MaxKeys != 1000 || result.IsTruncated {
+				t.Errorf("got Name %q, MaxKeys %d, IsTruncated %v", result.Name, result.MaxKeys, result.IsTruncated)
+			}
+			if len(result.Contents) != 2 {
+				t.Fatalf("got %d keys, want 2", len(result.Contents))
+			}
+			first := result.Contents[0]
+			if first.Key != "logs/a.txt" || first.Size != 12 || first.ETag != `"0cc175b9c0f1b6a831c399e269772661"` ||
+				first.LastModified != "2024-01-02T03:04:05.000Z" {
+				t.Errorf("got first key %+v", first)
+			}
+		})
+	}
+}
+
+func TestParseListPageMetadata(t *testing.T) {
+	listing := bucketListing{URL: "http://bucket.test/"}
+	result, ok := parseListPage(&listing, listing.URL, "application/xml", `"page-etag"`, readFixture(t, "listing-v2-page.xml"))
+	if !ok {
+		t.Fatalf("not parsed: %v", listing.Err)
+	}
+	if result.Name != "example" || result.Prefix != "logs/" || result.MaxKeys != 2 || result.KeyCount != 2 || !result.IsTruncated {
+		t.Errorf("got Name %q, Prefix %q, MaxKeys %d, KeyCount %d, IsTruncated %v",
+			result.Name, result.Prefix, result.MaxKeys, result.KeyCount, result.IsTruncated)
+	}
+	if result.NextContinuationToken != "1w41l63U0xa8q7smH50vCxyTQqdxo69O3EmK28Bi5PcROI4wI/EyIJg==" {
+		t.Errorf("got NextContinuationToken %q", result.NextContinuationToken)
+	}
+	if listing.ETags[listing.URL] != `"page-etag"` {
+		t.Errorf("ETag of the first page not recorded: %v", listing.ETags)
+	}
+}
+
+func TestParseListPageRejectsHTML(t *testing.T) {
+	listing := bucketListing{URL: "http://bucket.test/"}
+	if _, ok := parseListPage(&listing, listing.URL, "text/html", "", []byte("<html>ListBucketResult</html>")); ok {
+		t.Error("HTML page parsed as a listing")
+	}
+	if _, ok := parseListPage(&listing, listing.URL, "application/xml", "", []byte("<Error><Code>AccessDenied</Code></Error>")); ok {
+		t.Error("error document parsed as a listing")
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	defer func(version int) { *listVersion = version }(*listVersion)
+	page := func(keys ...string) ListBucketResult {
+		document := "<ListBucketResult>"
+		for _, key := range keys {
+			document += "<Contents><Key>" + key + "</Key></Contents>"
+		}
+		var result ListBucketResult
+		if err := xml.Unmarshal([]byte(document+"</ListBucketResult>"), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	with := func(result ListBucketResult, change func(*ListBucketResult)) ListBucketResult {
+		change(&result)
+		return result
+	}
+	tests := []struct {
+		name    string
+		version int
+		result  ListBucketResult
+		want    pageToken
+		more    bool
+	}{
+		{name: "empty page", version: 1, result: page()},
+		{name: "last page", version: 1, result: with(page("a", "b"), func(r *ListBucketResult) { r.MaxKeys = 1000 })},
+		{name: "v1 truncated with NextMarker", version: 1,
+			result: with(page("a", "b"), func(r *ListBucketResult) { r.IsTruncated, r.NextMarker = true, "b" }),
+			want:   pageToken{"marker", "b"}, more: true},
+		{name: "v1 truncated without NextMarker", version: 1,
+			result: with(page("a", "b"), func(r *ListBucketResult) { r.IsTruncated = true }),
+			want:   pageToken{"marker", "b"}, more: true},
+		{name: "full page without IsTruncated", version: 1,
+			result: with(page("a", "b"), func(r *ListBucketResult) { r.MaxKeys, r.KeyCount = 2, 2 }),
+			want:   pageToken{"marker", "b"}, more: true},
+		{name: "KeyCount below MaxKeys", version: 2,
+			result: with(page("a"), func(r *ListBucketResult) { r.MaxKeys, r.KeyCount = 2, 1 })},
+		{name: "v2 continuation token", version: 2,
+			result: with(page("a", "b"), func(r *ListBucketResult) { r.IsTruncated, r.KeyCount, r.NextContinuationToken = true, 2, "next" }),
+			want:   pageToken{"continuation-token", "next"}, more: true},
+		{name: "v2 without a token", version: 2,
+			result: with(page("a", "b"), func(r *ListBucketResult) { r.IsTruncated, r.KeyCount = true, 2 }),
+			want:   pageToken{"start-after", "b"}, more: true},
+		{name: "v1 answer to a v2 request", version: 2,
+			result: with(page("a", "b"), func(r *ListBucketResult) { r.IsTruncated, r.NextMarker = true, "b" }),
+			want:   pageToken{"marker", "b"}, more: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*listVersion = test.version
+			got, more := nextPage(test.result)
+			if got != test.want || more != test.more {
+				t.Errorf("nextPage = %v, %v, want %v, %v", got, more, test.want, test.more)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// listProgressInterval is the minimum time between two redraws of the listing progress
+const listProgressInterval = 100 * time.Millisecond
+
+// listingProgress is the live count of keys found while a bucket is listed,
+// drawn on one line of stderr so that paginating a huge bucket visibly
+// progresses. The pages of concurrent -prefixes-file listings add up.
+type listingProgress struct {
+	mu       sync.Mutex
+	enabled  bool
+	bucket   string
+	keys     int
+	pages    int
+	drawn    bool
+	lastDraw time.Time
+}
+
+// listProgress is the progress of the bucket being listed
+var listProgress listingProgress
+
+// start resets the count for a bucket. The progress is only shown on a
+// terminal, and never with -quiet or -json.
+func (p *listingProgress) start(bucketURL string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enabled = !*quiet && !*jsonOutput && isTerminal(os.Stderr)
+	p.bucket, p.keys, p.pages = bucketURL, 0, 0
+}
+
+// page adds the keys of a parsed page and redraws the count
+func (p *listingProgress) page(keys int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys += keys
+	p.pages++
+	if !p.enabled || time.Since(p.lastDraw) < listProgressInterval {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[KListing %s: %d keys found (page %d)", p.bucket, p.keys, p.pages)
+	p.drawn = true
+	p.lastDraw = time.Now()
+}
+
+// done clears the progress line once the bucket is listed
+func (p *listingProgress) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.drawn {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.drawn = false
+	}
+}
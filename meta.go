@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// metaSuffix is appended to the local path or archive name of a download for its -meta sidecar
+const metaSuffix = ".meta"
+
+// objectMetadata is the -meta sidecar of a downloaded object: the response
+// headers that record where the content came from and what the server said about it
+type objectMetadata struct {
+	URL           string            `json:"url"`
+	Key           string            `json:"key"`
+	DownloadedAt  time.Time         `json:"downloaded_at"`
+	ContentType   string            `json:"content_type,omitempty"`
+	ContentLength string            `json:"content_length,omitempty"`
+	ETag          string            `json:"etag,omitempty"`
+	LastModified  string            `json:"last_modified,omitempty"`
+	Encryption    string            `json:"server_side_encryption"` // "none" without SSE headers
+	Amz           map[string]string `json:"amz,omitempty"`          // x-amz-* headers, including x-amz-meta-* user metadata
+}
+
+// newObjectMetadata collects the sidecar fields from the headers of a download
+func newObjectMetadata(object s3Object, header http.Header) objectMetadata {
+	meta := objectMetadata{
+		URL:           object.url(),
+		Key:           object.Key,
+		DownloadedAt:  time.Now().UTC().Truncate(time.Second),
+		ContentType:   header.Get("Content-Type"),
+		ContentLength: header.Get("Content-Length"),
+		ETag:          header.Get("ETag"),
+		LastModified:  header.Get("Last-Modified"),
+		Encryption:    encryptionStatus(header),
+	}
+	for name, values := range header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			if meta.Amz == nil {
+				meta.Amz = make(map[string]string)
+			}
+			meta.Amz[name] = strings.Join(values, ", ")
+		}
+	}
+	return meta
+}
+
+// writeMetadata writes the -meta sidecar of a download next to its local
+// file, or as an entry next to it in the -zip or -tar archive
+func writeMetadata(object s3Object, localFile string, header http.Header) {
+	data, err := json.MarshalIndent(newObjectMetadata(object, header), "", "  ")
+	if err != nil {
+		debugLog("Failed to encode metadata of %s: %v", object.url(), err)
+		return
+	}
+	data = append(data, '\n')
+
+	if outputArchive == nil {
+		if guardLocalPath(localFile+metaSuffix) != nil {
+			return
+		}
+		err := writeMetadataFile(localFile+metaSuffix, data)
+		if errors.Is(err, fs.ErrExist) {
+			debugLog("Not overwriting existing file %s", localFile+metaSuffix)
+		} else if err != nil {
+			debugLog("Failed to write metadata of %s: %v", object.url(), err)
+		}
+		return
+	}
+	temp, err := os.CreateTemp("", "s3explorer-*")
+	if err != nil {
+		debugLog("Failed to create temporary file: %v", err)
+		return
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		debugLog("Failed to write metadata of %s: %v", object.url(), err)
+		os.Remove(temp.Name())
+		return
+	}
+	outputArchive.entries <- archiveEntry{name: archiveName(object) + metaSuffix, modTime: time.Now(), tempFile: temp.Name()}
+}
+
+// writeMetadataFile writes a sidecar file. With -no-overwrite or
+// -skip-existing an existing sidecar is kept, like the downloaded file itself.
+func writeMetadataFile(path string, data []byte) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if *noOverwrite || *skipExisting {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	}
+	file, err := os.OpenFile(path, flags, 0o666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
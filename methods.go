@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// probeMethodNames are the methods -probe-methods can test
+var probeMethodNames = []string{http.MethodOptions, http.MethodPost, http.MethodPut, http.MethodDelete}
+
+// modifyingMethods are the probe methods that send requests which could change the bucket
+var modifyingMethods = map[string]bool{http.MethodPost: true, http.MethodPut: true, http.MethodDelete: true}
+
+// methodResult is the answer of a bucket to one probe method
+type methodResult struct {
+	Method  string
+	Allowed bool
+	Detail  string
+}
+
+// String summarizes the result, e.g. "DELETE allowed (204)"
+func (r methodResult) String() string {
+	if r.Allowed {
+		return r.Method + " allowed (" + r.Detail + ")"
+	}
+	return r.Method + " denied (" + r.Detail + ")"
+}
+
+// parseProbeMethods validates -probe-methods and returns the methods to test
+func parseProbeMethods(value string) ([]string, error) {
+	var methods []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		known := false
+		for _, method := range probeMethodNames {
+			known = known || method == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown method %q, expected one of %s", name, strings.Join(probeMethodNames, ", "))
+		}
+		methods = append(methods, name)
+	}
+	return methods, nil
+}
+
+// probedMethods holds the methods selected with -probe-methods, set by run
+var probedMethods []string
+
+// probeBucketMethods tests the methods selected with -probe-methods against a bucket
+// and prints the results to stderr, after a warning if any of them could modify it
+func probeBucketMethods(bucketURL string) {
+	var modifying []string
+	for _, method := range probedMethods {
+		if modifyingMethods[method] {
+			modifying = append(modifying, method)
+		}
+	}
+	if len(modifying) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: sending %s requests to %s, which can modify the bucket\n", strings.Join(modifying, ", "), bucketURL)
+	}
+	for _, method := range probedMethods {
+		fmt.Fprintf(os.Stderr, "Methods of %s: %s\n", bucketURL, probeMethod(bucketURL, method))
+	}
+}
+
+// probeMethod tests one method against a bucket with a harmless request:
+//   - OPTIONS on the bucket, reporting the Allow header
+//   - POST of an empty body to the bucket, which uploads nothing
+//   - PUT of a small probe object, deleted again like the -audit write check
+//   - DELETE of a random key that does not exist
+func probeMethod(bucketURL, method string) methodResult {
+	result := methodResult{Method: method}
+	switch method {
+	case http.MethodPut:
+		severity, summary := probeWrite(bucketURL)
+		result.Allowed = severity == severityHigh
+		result.Detail = strings.TrimPrefix(summary, "publicly writable, ")
+		if strings.HasPrefix(summary, "not writable (") {
+			result.Detail = strings.TrimSuffix(strings.TrimPrefix(summary, "not writable ("), ")")
+		}
+		return result
+	case http.MethodDelete:
+		bucketURL = s3Object{Bucket: bucketURL, Key: probeKey("s3explorer-method-probe-")}.url()
+	}
+
+	req, err := http.NewRequest(method, bucketURL, nil)
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		debugLog("%s probe of %s failed: %v", method, bucketURL, err)
+		result.Detail = "request failed"
+		return result
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	result.Detail = fmt.Sprintf("status %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusMethodNotAllowed ||
+		resp.StatusCode == http.StatusNotImplemented || resp.StatusCode == http.StatusUnauthorized:
+		result.Detail = s3ErrorCode(resp.StatusCode, body)
+	case method == http.MethodOptions:
+		// OPTIONS only tells which methods the endpoint claims to allow
+		allow := resp.Header.Get("Allow")
+		if allow == "" {
+			allow = resp.Header.Get("Access-Control-Allow-Methods")
+		}
+		result.Allowed = resp.StatusCode < 300 && allow != ""
+		if allow != "" {
+			result.Detail += ", Allow: " + allow
+		}
+	case method == http.MethodPost:
+		// A POST without a form is rejected as malformed, not as forbidden, by buckets that accept uploads
+		code := s3ErrorCode(resp.StatusCode, body)
+		result.Allowed = resp.StatusCode < 300 || code == "MalformedPOSTRequest" || code == "InvalidArgument"
+		if resp.StatusCode >= 300 {
+			result.Detail = code
+		}
+	default:
+		result.Allowed = resp.StatusCode < 300
+		if !result.Allowed {
+			result.Detail = s3ErrorCode(resp.StatusCode, body)
+		}
+	}
+	return result
+}
+
+// methodsSeverity rates the -audit methods check: a DELETE accepted for any
+// key is high, OPTIONS advertising modifying methods is low
+func methodsSeverity(options, del methodResult) string {
+	if del.Allowed {
+		return severityHigh
+	}
+	if options.Allowed {
+		for method := range modifyingMethods {
+			if strings.Contains(options.Detail, method) {
+				return severityLow
+			}
+		}
+	}
+	return severityInfo
+}
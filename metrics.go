@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runMetrics are the counters exposed by -metrics-addr
+var runMetrics struct {
+	requests atomic.Int64 // requests sent
+	errors   atomic.Int64 // transport errors and responses with status >= 400
+	bytes    atomic.Int64 // response body bytes read
+	inFlight atomic.Int64 // requests whose response body is not closed yet
+}
+
+// metricsTransport updates runMetrics for every request passing through it
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip counts the request and wraps the response body to count bytes read
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	runMetrics.requests.Add(1)
+	runMetrics.inFlight.Add(1)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		runMetrics.errors.Add(1)
+		runMetrics.inFlight.Add(-1)
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		runMetrics.errors.Add(1)
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body}
+	return resp, nil
+}
+
+// countingBody adds the bytes read to runMetrics and ends the in-flight request on Close
+type countingBody struct {
+	io.ReadCloser
+	closeOnce sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	runMetrics.bytes.Add(int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.closeOnce.Do(func() { runMetrics.inFlight.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+// metricsHandler writes runMetrics in the Prometheus text exposition format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"s3explorer_requests_total", "counter", "HTTP requests sent.", runMetrics.requests.Load()},
+		{"s3explorer_errors_total", "counter", "Failed requests and responses with status >= 400.", runMetrics.errors.Load()},
+		{"s3explorer_response_bytes_total", "counter", "Response body bytes read.", runMetrics.bytes.Load()},
+		{"s3explorer_requests_in_flight", "gauge", "Requests whose response has not been fully read.", runMetrics.inFlight.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// startMetricsServer serves /metrics on addr and returns a function that shuts the server down
+func startMetricsServer(addr string) func() {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s for metrics: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+	debugLog("Serving metrics on http://%s/metrics", listener.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+}
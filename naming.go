@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// nameTemplate is the parsed -name-template, or nil when keys are saved under their base name
+var nameTemplate *template.Template
+
+// nameFields are the variables available to -name-template
+type nameFields struct {
+	Key  string // full object key
+	Host string // host (and port) of the bucket URL
+	Base string // last path segment of the key
+	Ext  string // extension of Base, including the dot
+}
+
+// parseNameTemplate parses and validates the -name-template flag by rendering a sample object
+func parseNameTemplate(text string) {
+	tmpl, err := template.New("name").Parse(text)
+	if err != nil {
+		log.Fatalf("Invalid -name-template: %v", err)
+	}
+	var b strings.Builder
+	sample := s3Object{Bucket: "https://bucket.s3.amazonaws.com", Key: "dir/file.txt"}
+	if err := tmpl.Execute(&b, newNameFields(sample)); err != nil {
+		log.Fatalf("Invalid -name-template: %v", err)
+	}
+	nameTemplate = tmpl
+}
+
+func newNameFields(object s3Object) nameFields {
+	key := namingKey(object)
+	base := filepath.Base(key)
+	host := object.Bucket
+	if u, err := url.Parse(object.Bucket); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return nameFields{Key: key, Host: host, Base: base, Ext: filepath.Ext(base)}
+}
+
+// namingKey returns the key local names are built from: the key itself, or with
+// -normalize-keys the key with duplicate slashes collapsed and leading slashes
+// stripped. Listings and reports always show the original key.
+func namingKey(object s3Object) string {
+	if !*normalizeKeys {
+		return object.Key
+	}
+	return normalizeKey(object.Key)
+}
+
+// normalizeKey collapses runs of slashes in a key and strips the leading ones
+func normalizeKey(key string) string {
+	for strings.Contains(key, "//") {
+		key = strings.ReplaceAll(key, "//", "/")
+	}
+	return strings.TrimLeft(key, "/")
+}
+
+// templateName renders -name-template for an object and sanitizes the result
+// into a relative path. It falls back to the base name if rendering fails.
+func templateName(object s3Object) string {
+	var b strings.Builder
+	if err := nameTemplate.Execute(&b, newNameFields(object)); err != nil {
+		debugLog("Failed to render -name-template for %s: %v", object.Key, err)
+		return filepath.Base(namingKey(object))
+	}
+	name := sanitizeRelativePath(b.String())
+	if name == "" {
+		return filepath.Base(namingKey(object))
+	}
+	return name
+}
+
+// sanitizeRelativePath turns a "/"-separated path into a relative local path that
+// cannot escape the current directory: empty, "." and ".." segments are dropped
+func sanitizeRelativePath(p string) string {
+	var segments []string
+	for _, segment := range strings.Split(filepath.ToSlash(p), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return filepath.Join(segments...)
+}
+
+// uniquePaths maps object URLs to the path chosen by assignUniquePaths for the
+// current batch of downloads
+var uniquePaths map[string]string
+
+// assignUniquePaths picks the path of every object of a batch before any of
+// them is downloaded. The path is rendered first (-name-template, then
+// -by-bucket); if an earlier object of the batch already took it, a number is
+// added before the extension (a.txt, a-2.txt, a-3.txt) so that no download
+// overwrites another one, and the name is shortened again if the number takes
+// it past -max-filename-length. Objects are numbered in listing order, which
+// keeps the names stable between runs.
+func assignUniquePaths(objects []s3Object, render func(s3Object) string) {
+	paths := make(map[string]string, len(objects))
+	taken := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		if _, ok := paths[object.url()]; ok {
+			continue
+		}
+		name := render(object)
+		candidate := name
+		for n := 2; taken[candidate]; n++ {
+			candidate = numberedPath(name, n)
+			if *maxFilenameLength > 0 {
+				candidate = limitSegmentLength(candidate, *maxFilenameLength)
+			}
+		}
+		if candidate != name {
+			debugLog("%s collides with another key, saving %s as %s", name, object.url(), candidate)
+		}
+		taken[candidate] = true
+		paths[object.url()] = candidate
+	}
+	uniquePaths = paths
+}
+
+// numberedPath inserts -n before the extension of a path
+func numberedPath(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// localPath returns the local file path an object is saved to, as assigned by
+// assignUniquePaths if the object is part of a batch. Paths beyond MAX_PATH
+// are returned in their Windows long-path form.
+func localPath(object s3Object) string {
+	if name, ok := uniquePaths[object.url()]; ok {
+		return longPath(name)
+	}
+	return longPath(renderLocalPath(object))
+}
+
+// renderLocalPath returns the -name-template result for an object if one is
+// set, the sanitized full key with -preserve-paths, the key flattened into
+// one name with -flatten, otherwise the base name of the key. -gunzip drops a
+// .gz extension, then -rename-ext rewrites the extension. With -by-bucket the
+// file is placed in a directory named after the source bucket. On Windows,
+// names Windows rejects are rewritten by windowsSafePath.
+func renderLocalPath(object s3Object) string {
+	name := filepath.Base(namingKey(object))
+	if nameTemplate != nil {
+		name = templateName(object)
+	} else if *preservePaths {
+		if name = sanitizeRelativePath(namingKey(object)); name == "" {
+			name = "_"
+		}
+	} else if *flatten {
+		name = flattenedName(object)
+	}
+	if *gunzip {
+		name = gunzippedName(name)
+	}
+	name = renameExt.rename(name)
+	if *byBucket {
+		name = filepath.Join(bucketDirName(object.Bucket), name)
+	}
+	name = platformSafePath(name)
+	if *maxFilenameLength > 0 {
+		name = limitSegmentLength(name, *maxFilenameLength)
+	}
+	return name
+}
+
+// flattenedName returns the sanitized full key of an object as a single file
+// name, with the directories joined by -flatten-separator
+func flattenedName(object s3Object) string {
+	name := strings.ReplaceAll(filepath.ToSlash(sanitizeRelativePath(namingKey(object))), "/", *flattenSeparator)
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// minFilenameLength is the smallest -max-filename-length, which leaves room
+// for the hash limitSegmentLength adds and a few bytes of the name
+const minFilenameLength = 16
+
+// limitSegmentLength shortens every segment of a path that is longer than
+// limit bytes, which most file systems reject. The segment is cut at a
+// character boundary and followed by a hash of the full segment, so that
+// different long names stay different, and its extension is kept unless the
+// extension alone is about as long as the limit. limit must be at least
+// minFilenameLength.
+func limitSegmentLength(p string, limit int) string {
+	segments := strings.Split(p, string(filepath.Separator))
+	for i, segment := range segments {
+		if len(segment) <= limit {
+			continue
+		}
+		sum := sha256.Sum256([]byte(segment))
+		hash := "-" + hex.EncodeToString(sum[:4])
+		suffix := hash + filepath.Ext(segment)
+		if len(suffix) >= limit {
+			suffix = hash
+		}
+		stem := segment[:limit-len(suffix)]
+		for cut := 0; cut < utf8.UTFMax && !utf8.ValidString(stem); cut++ {
+			stem = stem[:len(stem)-1]
+		}
+		segments[i] = stem + suffix
+		log.Printf("Shortened the %d byte file name %q to %q (-max-filename-length)", len(segment), segment, segments[i])
+	}
+	return strings.Join(segments, string(filepath.Separator))
+}
+
+// bucketDirName turns a bucket URL into a directory-safe name: its host (and
+// port), followed by the path for path-style URLs
+func bucketDirName(bucketURL string) string {
+	name := bucketURL
+	if u, err := url.Parse(bucketURL); err == nil && u.Host != "" {
+		name = u.Host + strings.TrimSuffix(u.Path, "/")
+	}
+	safe := []byte(name)
+	for i, c := range safe {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			safe[i] = '_'
+		}
+	}
+	if len(safe) == 0 || string(safe) == "." || string(safe) == ".." {
+		return "_"
+	}
+	return string(safe)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"unicode/utf8"
+)
+
+func TestAssignUniquePaths(t *testing.T) {
+	defer func(tmpl *template.Template) { nameTemplate = tmpl; uniquePaths = nil }(nameTemplate)
+
+	tests := []struct {
+		name     string
+		template string
+		keys     []string
+		want     []string
+	}{
+		{
+			name:     "template collapsing every key to one name",
+			template: "{{.Ext}}/all{{.Ext}}",
+			keys:     []string{"a/x.txt", "b/y.txt", "c/z.txt", "d/w.log"},
+			want:     []string{".txt/all.txt", ".txt/all-2.txt", ".txt/all-3.txt", ".log/all.log"},
+		},
+		{
+			name:     "base names from different directories",
+			template: "{{.Base}}",
+			keys:     []string{"logs/a.txt", "old/a.txt", "readme"},
+			want:     []string{"a.txt", "a-2.txt", "readme"},
+		},
+		{
+			name:     "name without an extension",
+			template: "dump",
+			keys:     []string{"a", "b"},
+			want:     []string{"dump", "dump-2"},
+		},
+		{
+			name:     "key already named like a counter, after the collision",
+			template: "{{.Base}}",
+			keys:     []string{"x/a.txt", "y/a.txt", "a-2.txt"},
+			want:     []string{"a.txt", "a-2.txt", "a-2-2.txt"},
+		},
+		{
+			name:     "key already named like a counter, before the collision",
+			template: "{{.Base}}",
+			keys:     []string{"a-2.txt", "x/a.txt", "y/a.txt"},
+			want:     []string{"a-2.txt", "a.txt", "a-3.txt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parseNameTemplate(test.template)
+			objects := make([]s3Object, len(test.keys))
+			for i, key := range test.keys {
+				objects[i] = s3Object{Bucket: "http://bucket.test", Key: key}
+			}
+			assignUniquePaths(objects, renderLocalPath)
+			for i, object := range objects {
+				if got, want := localPath(object), filepath.FromSlash(test.want[i]); got != want {
+					t.Errorf("%s is saved as %s, want %s", object.Key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitSegmentLength(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		name, path string
+		limit      int
+		wantExt    string
+	}{
+		{name: "extension kept", path: long + ".pdf", limit: 255, wantExt: ".pdf"},
+		{name: "minimum limit", path: long + ".pdf", limit: minFilenameLength, wantExt: ".pdf"},
+		{name: "extension as long as the limit", path: long + "." + strings.Repeat("x", 20), limit: minFilenameLength},
+		{name: "multibyte boundary", path: strings.Repeat("é", 200) + ".txt", limit: 100, wantExt: ".txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := limitSegmentLength(filepath.Join("dir", test.path), test.limit)
+			dir, base := filepath.Split(got)
+			if dir != "dir"+string(filepath.Separator) {
+				t.Errorf("directory changed: %q", got)
+			}
+			if len(base) > test.limit || !utf8.ValidString(base) {
+				t.Errorf("got %d byte name %q, limit %d", len(base), base, test.limit)
+			}
+			if filepath.Ext(base) != test.wantExt && test.wantExt != "" {
+				t.Errorf("%q lost the extension %s", base, test.wantExt)
+			}
+		})
+	}
+	if limitSegmentLength(long+"1", 255) == limitSegmentLength(long+"2", 255) {
+		t.Error("different long names are shortened to the same name")
+	}
+}
+
+func TestAssignUniquePathsLimit(t *testing.T) {
+	defer func(tmpl *template.Template, limit int) {
+		nameTemplate, *maxFilenameLength, uniquePaths = tmpl, limit, nil
+	}(nameTemplate, *maxFilenameLength)
+	*maxFilenameLength = 20
+	parseNameTemplate(strings.Repeat("n", 16) + ".txt")
+	objects := []s3Object{{Bucket: "http://bucket.test", Key: "a"}, {Bucket: "http://bucket.test", Key: "b"}}
+	assignUniquePaths(objects, renderLocalPath)
+	first, second := localPath(objects[0]), localPath(objects[1])
+	if first == second || len(first) > 20 || len(second) > 20 {
+		t.Errorf("saved as %q and %q, want two names of at most 20 bytes", first, second)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// messageBuffer holds the log messages of one of several concurrent listings
+// until they can be printed in input order, so that runs with -prefixes-file
+// log the same lines in the same order and can be diffed. A nil messageBuffer
+// logs right away.
+type messageBuffer struct {
+	lines []string
+}
+
+// newMessageBuffer returns a buffer for a concurrent listing with -ordered,
+// which is the default when stderr is redirected to a file, or nil otherwise
+func newMessageBuffer() *messageBuffer {
+	if !*ordered && isTerminal(os.Stderr) {
+		return nil
+	}
+	return &messageBuffer{}
+}
+
+// printf logs a message, or holds it back until flush
+func (b *messageBuffer) printf(format string, v ...interface{}) {
+	if b == nil {
+		log.Printf(format, v...)
+		return
+	}
+	b.lines = append(b.lines, fmt.Sprintf(format, v...))
+}
+
+// debugf is printf for messages only shown with -debug
+func (b *messageBuffer) debugf(format string, v ...interface{}) {
+	if *debug {
+		b.printf(format, v...)
+	}
+}
+
+// flush logs the held back messages
+func (b *messageBuffer) flush() {
+	if b == nil {
+		return
+	}
+	for _, line := range b.lines {
+		log.Print(line)
+	}
+	b.lines = nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// jsonSchemaVersion is bumped whenever a field of the JSON report is removed or changes meaning.
+// Adding fields is backwards compatible and keeps the version. See docs/output.schema.json.
+const jsonSchemaVersion = 1
+
+// jsonReport is the top-level document written by -json
+type jsonReport struct {
+	SchemaVersion int            `json:"schema_version"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+	Buckets       []jsonBucket   `json:"buckets"`
+	Objects       []jsonObject   `json:"objects"`
+	Audits        []*bucketAudit `json:"audits,omitempty"` // only with -audit
+	Diff          *jsonDiff      `json:"diff,omitempty"`   // only with -diff
+}
+
+// jsonGroupedReport is the -json report written with -json-by-bucket, which
+// keeps the keys of each bucket next to its listing
+type jsonGroupedReport struct {
+	SchemaVersion int                        `json:"schema_version"`
+	GeneratedAt   time.Time                  `json:"generated_at"`
+	ByBucket      map[string]jsonBucketGroup `json:"by_bucket"`        // keyed by bucket URL
+	Audits        []*bucketAudit             `json:"audits,omitempty"` // only with -audit
+	Diff          *jsonDiff                  `json:"diff,omitempty"`   // only with -diff
+}
+
+// jsonBucketGroup is one bucket of the -json-by-bucket report
+type jsonBucketGroup struct {
+	*jsonBucket              // listing of the bucket, absent for keys read with -input-json
+	Objects     []jsonObject `json:"objects"`
+}
+
+// jsonBucket describes the listing of one bucket URL in the JSON report
+type jsonBucket struct {
+	URL       string `json:"url"`
+	Status    string `json:"status"`
+	Name      string `json:"name"`
+	Prefix    string `json:"prefix"`
+	MaxKeys   int    `json:"max_keys"`
+	KeyCount  int    `json:"key_count"`
+	Truncated bool   `json:"truncated"`
+	Stopped   bool   `json:"requests_stopped,omitempty"` // only when -max-errors-per-bucket stopped its downloads
+}
+
+// jsonObject is a single listed key in the JSON report
+type jsonObject struct {
+	Key          string            `json:"key"`
+	URL          string            `json:"url"`
+	BucketURL    string            `json:"bucket_url"`
+	Host         string            `json:"host"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag,omitempty"`                   // only for listed keys
+	LastModified string            `json:"last_modified,omitempty"`          // only for listed keys
+	ContentType  string            `json:"content_type,omitempty"`           // only for downloaded keys
+	Encryption   string            `json:"server_side_encryption,omitempty"` // only for downloaded or HEADed keys
+	Tags         map[string]string `json:"tags,omitempty"`                   // only with -tags
+	Grep         *grepResult       `json:"grep,omitempty"`                   // only for keys that matched -grep
+	Secrets      *secretResult     `json:"secrets,omitempty"`                // only for keys with -secrets findings
+}
+
+// writeJSONReport writes the bucket listings and objects as a versioned JSON
+// report, grouped by bucket with -json-by-bucket
+func writeJSONReport(w io.Writer, objects []s3Object, listings []bucketListing) error {
+	if *jsonByBucket {
+		return writeJSON(w, newGroupedReport(objects, listings))
+	}
+	report := jsonReport{
+		SchemaVersion: jsonSchemaVersion,
+		GeneratedAt:   time.Now().UTC(),
+		Buckets:       make([]jsonBucket, 0, len(listings)),
+		Objects:       make([]jsonObject, 0, len(objects)),
+		Diff:          newJSONDiff(listingChanges),
+	}
+	for _, listing := range listings {
+		report.Buckets = append(report.Buckets, newJSONBucket(listing))
+	}
+	if *audit {
+		report.Audits = sortedAudits()
+	}
+	for _, object := range objects {
+		report.Objects = append(report.Objects, newJSONObject(object))
+	}
+	return writeJSON(w, report)
+}
+
+// newGroupedReport builds the -json-by-bucket report. Every listed bucket
+// appears, even without keys, and keys from buckets that were not listed get
+// a group of their own.
+func newGroupedReport(objects []s3Object, listings []bucketListing) jsonGroupedReport {
+	report := jsonGroupedReport{
+		SchemaVersion: jsonSchemaVersion,
+		GeneratedAt:   time.Now().UTC(),
+		ByBucket:      make(map[string]jsonBucketGroup, len(listings)),
+		Diff:          newJSONDiff(listingChanges),
+	}
+	for _, listing := range listings {
+		bucket := newJSONBucket(listing)
+		report.ByBucket[listing.URL] = jsonBucketGroup{jsonBucket: &bucket, Objects: []jsonObject{}}
+	}
+	if *audit {
+		report.Audits = sortedAudits()
+	}
+	for _, object := range objects {
+		group := report.ByBucket[object.Bucket]
+		group.Objects = append(group.Objects, newJSONObject(object))
+		report.ByBucket[object.Bucket] = group
+	}
+	return report
+}
+
+func newJSONBucket(listing bucketListing) jsonBucket {
+	return jsonBucket{
+		URL:       listing.URL,
+		Status:    string(listing.Status),
+		Name:      listing.Name,
+		Prefix:    listing.Prefix,
+		MaxKeys:   listing.MaxKeys,
+		KeyCount:  listing.KeyCount,
+		Truncated: listing.Truncated,
+		Stopped:   breaker.isTripped(listing.URL),
+	}
+}
+
+func newJSONObject(object s3Object) jsonObject {
+	encryption, _ := objectEncryption(object)
+	return jsonObject{
+		Key:          object.Key,
+		URL:          object.url(),
+		BucketURL:    object.Bucket,
+		Host:         objectHost(object),
+		Size:         object.Size,
+		ETag:         object.ETag,
+		LastModified: object.LastModified,
+		ContentType:  downloadedType(object),
+		Encryption:   encryption,
+		Tags:         taggedObject(object),
+		Grep:         objectMatches(object),
+		Secrets:      objectSecrets(object),
+	}
+}
+
+// writeJSON writes a JSON report to w, indented if jsonPretty says so
+func writeJSON(w io.Writer, report any) error {
+	var data []byte
+	var err error
+	if jsonPretty(w) {
+		data, err = json.MarshalIndent(report, "", "  ")
+	} else {
+		data, err = json.Marshal(report)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// jsonPretty reports whether JSON written to w should be indented: as
+// requested with -json-pretty or -json-compact, otherwise only when w is a terminal
+func jsonPretty(w io.Writer) bool {
+	switch {
+	case *jsonPrettyFlag:
+		return true
+	case *jsonCompact:
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && isTerminal(f)
+}
+
+// writeKeyList writes the listed keys, one per line, as printed by -raw
+func writeKeyList(w io.Writer, objects []s3Object, _ []bucketListing) error {
+	for _, object := range objects {
+		if _, err := fmt.Fprintln(w, object.displayKey()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportOutput is a report written to a file, enabled by its own flag. The
+// outputs are independent of each other and of stdout, so that several can be
+// combined in one run, e.g. -of keys.txt -json-out report.json.
+type reportOutput struct {
+	flag  string
+	path  string
+	write func(w io.Writer, objects []s3Object, listings []bucketListing) error
+}
+
+// reportOutputs returns every report output, with the file given on the command line
+func reportOutputs() []reportOutput {
+	return []reportOutput{
+		{flag: "of", path: *keysOut, write: writeKeyList},
+		{flag: "json-out", path: *jsonOut, write: writeJSONReport},
+	}
+}
+
+// writeReportOutputs writes the report outputs that name a file. Like the
+// -json report they are written at the end of the run, after the downloads.
+func writeReportOutputs(objects []s3Object, listings []bucketListing) {
+	for _, output := range reportOutputs() {
+		if output.path == "" {
+			continue
+		}
+		if err := writeReportFile(output, objects, listings); err != nil {
+			log.Printf("Failed to write %s (-%s): %v", output.path, output.flag, err)
+		}
+	}
+}
+
+// writeReportFile creates the file of a report output and writes the report to it
+func writeReportFile(output reportOutput, objects []s3Object, listings []bucketListing) error {
+	file, err := os.Create(output.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = output.write(w, objects, listings)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// isTerminal reports whether the file is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// schemaPath is the JSON Schema of the -json report, absolute for the tests
+// that change the current directory
+var schemaPath, _ = filepath.Abs(filepath.Join("docs", "output.schema.json"))
+
+// loadSchema reads the report schema as generic JSON
+func loadSchema(t *testing.T) map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("invalid %s: %v", schemaPath, err)
+	}
+	return schema
+}
+
+// validateReport checks a report against the schema and fails the test with
+// every violation found
+func validateReport(t *testing.T, report []byte) {
+	t.Helper()
+	root := loadSchema(t)
+	var doc any
+	if err := json.Unmarshal(report, &doc); err != nil {
+		t.Fatalf("invalid report: %v", err)
+	}
+	for _, problem := range validate(root, root, doc, "$") {
+		t.Error(problem)
+	}
+}
+
+// validate checks a value against the part of JSON Schema the report schema
+// uses and returns the violations
+func validate(root, schema map[string]any, value any, path string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		return validate(root, resolveRef(root, ref), value, path)
+	}
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+	if want, ok := schema["type"].(string); ok && !hasType(value, want) {
+		fail("got %T, want %s", value, want)
+		return problems
+	}
+	if want, ok := schema["const"]; ok && value != want {
+		fail("got %v, want %v", value, want)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || value == allowed
+		}
+		if !found {
+			fail("%v is not one of %v", value, enum)
+		}
+	}
+	if minimum, ok := schema["minimum"].(float64); ok {
+		if n, isNumber := value.(float64); isNumber && n < minimum {
+			fail("%v is below the minimum %v", n, minimum)
+		}
+	}
+	if options, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, option := range options {
+			if len(validate(root, option.(map[string]any), value, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("matches %d of the oneOf schemas, want 1", matches)
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range value.([]any) {
+			problems = append(problems, validate(root, items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	object, isObject := value.(map[string]any)
+	if !isObject {
+		return problems
+	}
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if _, present := object[name.(string)]; !present {
+				fail("missing %s", name)
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]any)
+	for name, field := range object {
+		if property, ok := properties[name].(map[string]any); ok {
+			problems = append(problems, validate(root, property, field, path+"."+name)...)
+		} else if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+			problems = append(problems, validate(root, additional, field, path+"."+name)...)
+		}
+	}
+	return problems
+}
+
+// resolveRef returns the schema a local reference such as
+// #/properties/objects points to
+func resolveRef(root map[string]any, ref string) map[string]any {
+	schema := root
+	for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		schema = schema[name].(map[string]any)
+	}
+	return schema
+}
+
+// hasType reports whether a decoded JSON value is of a JSON Schema type
+func hasType(value any, want string) bool {
+	switch want {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == float64(int64(n))
+	}
+	return false
+}
+
+// reportObjects returns listed keys along with keys of unknown size, as read
+// with -input-json or given as presigned URLs
+func reportObjects() ([]s3Object, []bucketListing) {
+	listed := []s3Object{
+		{Bucket: "http://bucket.test/", Key: "logs/a.txt", Size: 12, ETag: `"abc"`, LastModified: "2024-01-02T03:04:05.000Z"},
+		{Bucket: "http://bucket.test/", Key: "empty/", Size: 0},
+	}
+	listing := bucketListing{URL: "http://bucket.test/", Status: listingOK, Name: "bucket", MaxKeys: 1000, KeyCount: 2, Objects: listed}
+	objects := append(listed,
+		s3Object{Bucket: "http://other.test", Key: "input.json", Size: -1},
+		s3Object{Bucket: "http://other.test", Key: "signed.bin", Size: -1, Query: "X-Amz-Signature=00"},
+	)
+	return objects, []bucketListing{listing}
+}
+
+func TestJSONReportMatchesSchema(t *testing.T) {
+	objects, listings := reportObjects()
+	var out bytes.Buffer
+	if err := writeJSONReport(&out, objects, listings); err != nil {
+		t.Fatal(err)
+	}
+	validateReport(t, out.Bytes())
+}
+
+func TestSchemaRejectsInvalidReport(t *testing.T) {
+	root := loadSchema(t)
+	report := map[string]any{
+		"schema_version": float64(2),
+		"generated_at":   "2024-01-02T03:04:05Z",
+		"buckets":        []any{},
+		"objects":        []any{map[string]any{"key": "a", "url": "http://bucket.test/a", "bucket_url": "http://bucket.test/", "host": "bucket.test", "size": float64(-2)}},
+	}
+	if problems := validate(root, root, report, "$"); len(problems) != 2 {
+		t.Errorf("got %d problems, want 2 (version and size): %v", len(problems), problems)
+	}
+}
+
+func TestJSONReportByBucket(t *testing.T) {
+	defer func(grouped bool) { *jsonByBucket = grouped }(*jsonByBucket)
+	*jsonByBucket = true
+	objects, listings := reportObjects()
+	var out bytes.Buffer
+	if err := writeJSONReport(&out, objects, listings); err != nil {
+		t.Fatal(err)
+	}
+	validateReport(t, out.Bytes())
+
+	var report struct {
+		Buckets  any                                   `json:"buckets"`
+		Objects  any                                   `json:"objects"`
+		ByBucket map[string]map[string]json.RawMessage `json:"by_bucket"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Buckets != nil || report.Objects != nil {
+		t.Error("grouped report has flat buckets or objects")
+	}
+	wantKeys := map[string][]string{
+		"http://bucket.test/": {"logs/a.txt", "empty/"},
+		"http://other.test":   {"input.json", "signed.bin"},
+	}
+	if len(report.ByBucket) != len(wantKeys) {
+		t.Errorf("got %d buckets, want %d", len(report.ByBucket), len(wantKeys))
+	}
+	for bucketURL, keys := range wantKeys {
+		group, ok := report.ByBucket[bucketURL]
+		if !ok {
+			t.Errorf("no group for %s", bucketURL)
+			continue
+		}
+		var groupObjects []jsonObject
+		if err := json.Unmarshal(group["objects"], &groupObjects); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, object := range groupObjects {
+			got = append(got, object.Key)
+			if object.BucketURL != bucketURL {
+				t.Errorf("%s of group %s has bucket_url %s", object.Key, bucketURL, object.BucketURL)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(keys, ",") {
+			t.Errorf("%s holds %v, want %v", bucketURL, got, keys)
+		}
+	}
+
+	listed := report.ByBucket["http://bucket.test/"]
+	for _, field := range []string{"url", "status", "name", "max_keys", "key_count", "truncated"} {
+		if _, ok := listed[field]; !ok {
+			t.Errorf("listed bucket has no %s", field)
+		}
+	}
+	// Keys read with -input-json come from a bucket that was not listed
+	if fields := report.ByBucket["http://other.test"]; len(fields) != 1 {
+		t.Errorf("unlisted bucket has fields besides objects: %v", fields)
+	}
+}
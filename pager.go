@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+)
+
+// defaultPagers are tried in order for -pager when $PAGER is not set
+var defaultPagers = []string{"less", "more"}
+
+// openPager starts the pager of -pager and returns the writer to print the
+// listing to, along with a function that closes it and waits for the user to
+// quit the pager. Without -pager, when stdout is not a terminal or when no
+// pager can be started, the listing goes to stdout directly.
+func openPager() (io.Writer, func()) {
+	if !*pagerFlag || !isTerminal(os.Stdout) {
+		return os.Stdout, func() {}
+	}
+	args := pagerCommand()
+	if args == nil {
+		debugLog("No pager found, printing the listing directly (-pager)")
+		return os.Stdout, func() {}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// Like git: quit when the listing fits on one screen, keep colors and
+	// leave the listing on the screen
+	cmd.Env = os.Environ()
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	pipe, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		debugLog("Failed to start pager %s, printing the listing directly: %v", args[0], err)
+		return os.Stdout, func() {}
+	}
+
+	// Ctrl-C is for the pager; exiting under it would leave it on the terminal
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	out := bufio.NewWriter(pipe)
+	return out, func() {
+		out.Flush()
+		pipe.Close()
+		cmd.Wait()
+		signal.Stop(interrupts)
+	}
+}
+
+// pagerCommand returns the command line of $PAGER, or of the first of
+// defaultPagers that is installed, or nil if there is none. PAGER=cat
+// turns paging off.
+func pagerCommand() []string {
+	if pager := strings.Fields(os.Getenv("PAGER")); len(pager) > 0 {
+		if pager[0] == "cat" {
+			return nil
+		}
+		if _, err := exec.LookPath(pager[0]); err == nil {
+			return pager
+		}
+		debugLog("$PAGER %s was not found", pager[0])
+	}
+	for _, pager := range defaultPagers {
+		if _, err := exec.LookPath(pager); err == nil {
+			return []string{pager}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probePorts are the ports S3-compatible services commonly listen on, by default:
+// the scheme default, MinIO, SeaweedFS, Ceph RGW, LocalStack, Dell ECS and a generic proxy port
+var probePorts = []string{"", "9000", "8333", "7480", "4566", "9020", "8080"}
+
+// probePaths are the paths the S3 API is commonly mounted on
+var probePaths = []string{"/", "/s3/"}
+
+// defaultProbeTimeout bounds each probe when -timeout is not set
+const defaultProbeTimeout = 5 * time.Second
+
+// probeResult is what a candidate endpoint answered
+type probeResult struct {
+	URL    string
+	Kind   string // listing, bucket list, s3 error, or empty if not S3
+	Detail string
+}
+
+// probeEndpoints tries the common scheme, port and path combinations of a host,
+// at most -t at a time, and prints those that answered like an S3 API.
+// A port in host restricts the probes to that port.
+func probeEndpoints(host string) int {
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+	ports := probePorts
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host, ports = h, []string{port}
+	}
+	host = strings.Trim(host, "[]")
+
+	var candidates []string
+	for _, scheme := range []string{"https", "http"} {
+		for _, port := range ports {
+			address := net.JoinHostPort(host, port)
+			if port == "" {
+				address = strings.TrimSuffix(address, ":")
+			}
+			for _, path := range probePaths {
+				candidates = append(candidates, scheme+"://"+address+path)
+			}
+		}
+	}
+
+	timeout := *requestTimeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	results := make([]probeResult, len(candidates))
+	semaphore := make(chan struct{}, *threads)
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, candidate string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i] = probeEndpoint(candidate, timeout)
+		}(i, candidate)
+	}
+	wg.Wait()
+
+	found := false
+	for _, result := range results {
+		if result.Kind == "" {
+			continue
+		}
+		found = true
+		fmt.Printf("Endpoint: %s (%s%s)\n", result.URL, result.Kind, result.Detail)
+	}
+	if !found {
+		fmt.Printf("No S3-compatible endpoint found on %s (%d probes)\n", host, len(candidates))
+		return exitBucketsFailed
+	}
+	return exitOK
+}
+
+// probeEndpoint sends a GET to a candidate endpoint and classifies the answer
+func probeEndpoint(endpoint string, timeout time.Duration) probeResult {
+	result := probeResult{URL: endpoint}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		debugLog("Invalid probe URL %s: %v", endpoint, err)
+		return result
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		debugLog("Probe of %s failed: %v", endpoint, err)
+		return result
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		debugLog("Error reading probe response from %s: %v", endpoint, err)
+		return result
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK && isListingResponse(resp.Header.Get("Content-Type"), body):
+		result.Kind = "listing"
+	case resp.StatusCode == http.StatusOK && bytes.Contains(body, []byte("ListAllMyBucketsResult")):
+		result.Kind = "bucket list"
+	default:
+		var s3Err S3Error
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			result.Kind, result.Detail = "s3 error", ": "+s3Err.Code
+		}
+	}
+	debugLog("Probe of %s: status %d, %q", endpoint, resp.StatusCode, result.Kind)
+	return result
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rangePattern matches a single byte range: bytes=START-END, bytes=START- or bytes=-SUFFIX
+var rangePattern = regexp.MustCompile(`^bytes=(\d*)-(\d*)$`)
+
+// parseByteRange validates a -range value and returns it as a Range header
+// value. The bytes= unit may be omitted.
+func parseByteRange(value string) (string, error) {
+	if !strings.HasPrefix(value, "bytes=") {
+		value = "bytes=" + value
+	}
+	m := rangePattern.FindStringSubmatch(value)
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return "", fmt.Errorf("invalid byte range %q, expected e.g. bytes=0-1023", value)
+	}
+	if m[1] != "" && m[2] != "" {
+		start, err1 := strconv.ParseInt(m[1], 10, 64)
+		end, err2 := strconv.ParseInt(m[2], 10, 64)
+		if err1 != nil || err2 != nil || end < start {
+			return "", fmt.Errorf("invalid byte range %q, the end is before the start", value)
+		}
+	}
+	return value, nil
+}
+
+// rangeFileName returns the local file a byte range of an object is saved to,
+// e.g. archive.zip.bytes-0-1023, so it is never mistaken for the full object
+func rangeFileName(object s3Object, byteRange string) string {
+	return localPath(object) + "." + strings.Replace(byteRange, "=", "-", 1)
+}
+
+// downloadRange fetches a byte range of an object and saves it next to where
+// the full object would be saved. A server that ignores Range sends the whole
+// object, which is saved as well with a warning.
+func downloadRange(object s3Object, byteRange string) bool {
+	url := object.url()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		debugLog("Invalid URL %s: %v", url, err)
+		return false
+	}
+	req.Header.Set("Range", byteRange)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		debugLog("Failed to download %s: %v", url, err)
+		recordFailedDownload(object)
+		return false
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		debugLog("Received %s of %s", resp.Header.Get("Content-Range"), url)
+	case http.StatusOK:
+		log.Printf("%s ignored the Range header, saving the full object", url)
+	case http.StatusRequestedRangeNotSatisfiable:
+		log.Printf("Range %s is not satisfiable for %s (%s)", byteRange, url, resp.Header.Get("Content-Range"))
+		return false
+	default:
+		debugLog("Failed to download %s, status code: %d", url, resp.StatusCode)
+		recordFailedDownload(object)
+		return false
+	}
+
+	localFile := rangeFileName(object, byteRange)
+	sniffer := &sniffReader{r: resp.Body}
+	if err := saveToFile(localFile, sniffer); err != nil {
+		if !errors.Is(err, fs.ErrExist) {
+			recordFailedDownload(object)
+		}
+		return false
+	}
+	// The sniffed type is only meaningful for the start of the object
+	var contentType string
+	if strings.HasPrefix(byteRange, "bytes=0-") {
+		recordContentType(object, resp.Header.Get("Content-Type"), sniffer.head)
+		contentType = " (" + downloadedType(object) + ")"
+	}
+	fmt.Printf("Saved %s of %s to %s%s\n", byteRange, object.displayKey(), localFile, contentType)
+	return true
+}
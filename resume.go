@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partSuffix is appended to the local path of a download in progress with -resume
+const partSuffix = ".part"
+
+// partInfo is stored next to a .part file so that a later run can tell
+// whether the partial content still belongs to the object
+type partInfo struct {
+	URL  string `json:"url"`
+	Size int64  `json:"size"` // Content-Length of the whole object, -1 if unknown
+	ETag string `json:"etag,omitempty"`
+}
+
+// partInfoPath returns the path of the partInfo of a .part file
+func partInfoPath(partFile string) string {
+	return partFile + ".json"
+}
+
+// readPartInfo loads the partInfo of a .part file
+func readPartInfo(partFile string) (partInfo, bool) {
+	var info partInfo
+	data, err := os.ReadFile(partInfoPath(partFile))
+	if err != nil {
+		return info, false
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		debugLog("Ignoring invalid %s: %v", partInfoPath(partFile), err)
+		return info, false
+	}
+	return info, true
+}
+
+// writePartInfo stores the partInfo of a .part file
+func writePartInfo(partFile string, info partInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partInfoPath(partFile), data, 0o666)
+}
+
+// scanPartialDownloads logs the .part files left below dir by an interrupted
+// run. Those of the objects about to be downloaded are resumed. The others
+// belong to keys this run leaves out, for example because of -f, -l or
+// -sample, and are logged one by one so that they are not silently left
+// behind.
+func scanPartialDownloads(dir string, objects []s3Object) {
+	downloading := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		downloading[object.url()] = true
+	}
+	count := 0
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(path, partSuffix) {
+			if info, ok := readPartInfo(path); ok && downloading[info.URL] {
+				debugLog("Found partial download of %s in %s", info.URL, path)
+				count++
+			} else if ok {
+				log.Printf("Not resuming %s, %s is not downloaded in this run", path, info.URL)
+			}
+		}
+		return nil
+	})
+	if count > 0 {
+		log.Printf("Found %d partial downloads to resume", count)
+	}
+}
+
+// resumeDownload downloads an object into localFile through a .part file.
+// If a .part file of the same object is left from an earlier run, only the
+// missing bytes are requested, with If-Range so that an object that changed
+// since is downloaded again from the start. The .part file is kept when the
+// download fails, and renamed to localFile once complete. stalled is true if
+// -stall-timeout canceled the download; the bytes it reported are then taken
+// back from the progress, and the failure is left to the caller, which may
+// resume from the .part file.
+func resumeDownload(object s3Object, localFile string, progress func(int64)) (ok, stalled bool) {
+	url := object.url()
+	partFile := localFile + partSuffix
+	var offset int64
+	info, found := readPartInfo(partFile)
+	if found && info.URL == url {
+		if stat, err := os.Stat(partFile); err == nil {
+			offset = stat.Size()
+		}
+	}
+
+	ctx, cancel, watch := newStallWatch(context.Background(), *stallTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		debugLog("Invalid URL %s: %v", url, err)
+		recordFailedDownload(object)
+		return false, false
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if info.ETag != "" {
+			req.Header.Set("If-Range", info.ETag)
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if watch.fired() {
+			return false, true
+		}
+		debugLog("Failed to download %s: %v", url, err)
+		recordFailedDownload(object)
+		return false, false
+	}
+	defer resp.Body.Close()
+
+	// Progress counts the bytes of the .part file too, all of which are taken
+	// back if the download stalls
+	var reported int64
+	report := func(n int64) {
+		reported += n
+		if progress != nil {
+			progress(n)
+		}
+	}
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		contentRange := resp.Header.Get("Content-Range")
+		if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) ||
+			(info.Size >= 0 && !strings.HasSuffix(contentRange, fmt.Sprintf("/%d", info.Size))) ||
+			(info.ETag != "" && resp.Header.Get("ETag") != "" && resp.Header.Get("ETag") != info.ETag) {
+			debugLog("Partial download of %s does not match the object, downloading it again", url)
+			resp.Body.Close()
+			cancel()
+			os.Remove(partFile)
+			return resumeDownload(object, localFile, progress)
+		}
+		debugLog("Resuming %s at byte %d", url, offset)
+		report(offset)
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset == info.Size:
+		debugLog("Partial download of %s was already complete", url)
+		report(offset)
+		return finishPartialDownload(object, localFile, partFile, resp.Header), false
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		debugLog("Partial download of %s is longer than the object, downloading it again", url)
+		resp.Body.Close()
+		cancel()
+		os.Remove(partFile)
+		return resumeDownload(object, localFile, progress)
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			debugLog("%s changed or ignores ranges, downloading it again", url)
+		}
+		offset = 0
+		info = partInfo{URL: url, Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	default:
+		debugLog("Failed to download %s, status code: %d", url, resp.StatusCode)
+		recordFailedDownload(object)
+		return false, false
+	}
+
+	if guardLocalPath(partFile) != nil || guardLocalPath(partInfoPath(partFile)) != nil {
+		recordFailedDownload(object)
+		return false, false
+	}
+	if dir := filepath.Dir(partFile); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			debugLog("Failed to create directory %s: %v", dir, err)
+			recordFailedDownload(object)
+			return false, false
+		}
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if err := writePartInfo(partFile, info); err != nil {
+			debugLog("Failed to write %s: %v", partInfoPath(partFile), err)
+			recordFailedDownload(object)
+			return false, false
+		}
+	}
+	file, err := os.OpenFile(partFile, flags, 0o666)
+	if err != nil {
+		debugLog("Failed to open %s: %v", partFile, err)
+		recordFailedDownload(object)
+		return false, false
+	}
+	n, err := io.Copy(file, &progressReader{r: watch.reader(resp.Body), progress: report})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && watch.fired() {
+		debugLog("Download of %s stalled at byte %d, keeping %s", url, offset+n, partFile)
+		if progress != nil {
+			progress(-reported)
+		}
+		return false, true
+	}
+	if err == nil && info.Size >= 0 && offset+n != info.Size {
+		err = fmt.Errorf("got %d of %d bytes", offset+n, info.Size)
+	}
+	if err != nil {
+		debugLog("Download of %s interrupted, keeping %s: %v", url, partFile, err)
+		recordFailedDownload(object)
+		return false, false
+	}
+	return finishPartialDownload(object, localFile, partFile, resp.Header), false
+}
+
+// finishPartialDownload moves a complete .part file to its local path
+func finishPartialDownload(object s3Object, localFile, partFile string, header http.Header) bool {
+	if *noOverwrite || *skipExisting {
+		if _, err := os.Stat(localFile); err == nil {
+			log.Printf("Not overwriting %s, the download is kept in %s", localFile, partFile)
+			skippedExisting.Add(1)
+			return false
+		}
+	}
+	if guardLocalPath(localFile) != nil {
+		recordFailedDownload(object)
+		return false
+	}
+	if err := os.Rename(partFile, localFile); err != nil {
+		debugLog("Failed to rename %s: %v", partFile, err)
+		recordFailedDownload(object)
+		return false
+	}
+	os.Remove(partInfoPath(partFile))
+
+	// A resumed download was not read from the start, so sniff the saved file
+	head := make([]byte, sniffLen)
+	if file, err := os.Open(localFile); err == nil {
+		n, _ := io.ReadFull(file, head)
+		head = head[:n]
+		file.Close()
+	}
+	recordContentType(object, header.Get("Content-Type"), head)
+	recordEncryption(object, header)
+	if *metaFlag {
+		writeMetadata(object, localFile, header)
+	}
+	state.markKey(object)
+	if info, err := os.Stat(localFile); err == nil {
+		recordDownload(info.Size())
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestScanPartialDownloads(t *testing.T) {
+	t.Chdir(t.TempDir())
+	listed := s3Object{Bucket: "http://bucket.test", Key: "listed.bin"}
+	for _, url := range []string{listed.url(), "http://bucket.test/filtered.bin"} {
+		partFile := url[strings.LastIndex(url, "/")+1:] + partSuffix
+		if err := os.WriteFile(partFile, []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writePartInfo(partFile, partInfo{URL: url, Size: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	scanPartialDownloads(".", []s3Object{listed})
+	logged := out.String()
+	if !strings.Contains(logged, "Not resuming filtered.bin.part, http://bucket.test/filtered.bin") {
+		t.Errorf("partial download of a key left out of the run not logged:\n%s", logged)
+	}
+	if strings.Contains(logged, "Not resuming listed.bin.part") || !strings.Contains(logged, "Found 1 partial downloads") {
+		t.Errorf("partial download of a listed key not counted:\n%s", logged)
+	}
+}
+
+func TestFinishPartialDownloadNoOverwrite(t *testing.T) {
+	t.Chdir(t.TempDir())
+	setFlags(t, map[string]string{"no-overwrite": "true"})
+	defer func(n int64) { skippedExisting.Store(n) }(skippedExisting.Load())
+	for name, content := range map[string]string{"a.bin": "old", "a.bin" + partSuffix: "new"} {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := skippedExisting.Load()
+	if finishPartialDownload(s3Object{Bucket: "http://bucket.test", Key: "a.bin"}, "a.bin", "a.bin"+partSuffix, nil) {
+		t.Fatal("existing file overwritten")
+	}
+	if data, _ := os.ReadFile("a.bin"); string(data) != "old" {
+		t.Errorf("a.bin holds %q", data)
+	}
+	if skippedExisting.Load() != before+1 {
+		t.Error("kept file not counted as skipped")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// failedDownloads collects the objects whose download failed, for -failed-out
+var failedDownloads struct {
+	sync.Mutex
+	objects []s3Object
+}
+
+// recordFailedDownload remembers a failed download
+func recordFailedDownload(object s3Object) {
+	breaker.failure(object)
+	failedDownloads.Lock()
+	failedDownloads.objects = append(failedDownloads.objects, object)
+	failedDownloads.Unlock()
+}
+
+// failedDownloadCount returns the number of downloads that failed so far
+func failedDownloadCount() int {
+	failedDownloads.Lock()
+	defer failedDownloads.Unlock()
+	return len(failedDownloads.objects)
+}
+
+// writeFailedDownloads writes the URL of every failed download to a file, one per line.
+// The file is written even when nothing failed so a stale list is never left behind.
+func writeFailedDownloads(filename string) {
+	failedDownloads.Lock()
+	defer failedDownloads.Unlock()
+
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Printf("Failed to create %s: %v", filename, err)
+		return
+	}
+	defer file.Close()
+
+	for _, object := range failedDownloads.objects {
+		fmt.Fprintln(file, object.url())
+	}
+	if n := len(failedDownloads.objects); n > 0 {
+		fmt.Printf("Wrote %d failed downloads to %s\n", n, filename)
+	}
+}
+
+// retryFailedDownloads re-attempts the downloads listed in a -failed-out file.
+// Keys that still fail are written to -failed-out, or to <file>.retry so the
+// input file is never overwritten.
+func retryFailedDownloads(filename string) {
+	objects := readObjectURLs(filename)
+	if len(objects) == 0 {
+		log.Fatalf("No URLs to retry in %s", filename)
+	}
+	runTotals.keysFound = len(objects)
+	downloadAllKeys(objects, *threads)
+
+	out := *failedOut
+	if out == "" || out == filename {
+		out = filename + ".retry"
+	}
+	writeFailedDownloads(out)
+}
+
+// downloadPresignedURLs downloads the objects of a file of presigned URLs,
+// such as links obtained from an application, without listing any bucket.
+// The query that carries the signature is sent with the requests, but file
+// names are derived from the path alone.
+func downloadPresignedURLs(filename string) {
+	objects := readObjectURLs(filename)
+	if len(objects) == 0 {
+		log.Fatalf("No URLs to download in %s", filename)
+	}
+	runTotals.keysFound = len(objects)
+	downloadAllKeys(objects, *threads)
+	if *failedOut != "" {
+		writeFailedDownloads(*failedOut)
+	}
+}
+
+// readObjectURLs reads a file of object URLs, one per line, skipping blank lines and invalid URLs
+func readObjectURLs(filename string) []s3Object {
+	var objects []s3Object
+	for _, line := range readLines(filename) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		object, err := objectFromURL(line)
+		if err != nil {
+			log.Printf("Skipping invalid URL %q in %s: %v", redactedURL(line), filename, err)
+			continue
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+// redactedURL returns a URL string with credential query parameters masked
+func redactedURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return redactURL(u)
+}
+
+// objectFromURL splits a full object URL into its bucket URL (scheme and host),
+// key and query, which holds the signature of presigned URLs
+func objectFromURL(rawURL string) (s3Object, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return s3Object{}, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return s3Object{}, fmt.Errorf("not an absolute URL")
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return s3Object{}, fmt.Errorf("URL has no key")
+	}
+	return s3Object{Bucket: u.Scheme + "://" + u.Host, Key: key, Size: -1, Query: u.RawQuery}, nil
+}
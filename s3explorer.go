@@ -2,187 +2,1063 @@ package main
 
 import (
 	"bufio"
-	"encoding/xml"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
 )
 
-// XML structure for parsing S3 ListBucket result
-type ListBucketResult struct {
-	Contents []struct {
-		Key string `xml:"Key"`
-	} `xml:"Contents"`
+// s3Object is a single key listed from a bucket
+type s3Object struct {
+	Bucket string // bucket URL the key was listed from
+	Key    string
+	Size   int64  // size in bytes, or -1 when unknown
+	Query  string // query of a presigned URL, sent with every request but not part of local names
+
+	ETag         string // as reported by the listing, if any
+	LastModified string
+}
+
+// url returns the full URL of the object
+func (o s3Object) url() string {
+	if o.Query != "" {
+		return fmt.Sprintf("%s/%s?%s", strings.TrimSuffix(o.Bucket, "/"), o.Key, o.Query)
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(o.Bucket, "/"), o.Key)
+}
+
+// displayKey returns the key as shown to the user, prefixed with the bucket URL
+// if -U is set or the key was listed from a followed bucket
+func (o s3Object) displayKey() string {
+	if *urlFileFlag != "" || o.Bucket != *urlFlag {
+		return o.url()
+	}
+	return o.Key
 }
 
 var (
-	urlFlag     = flag.String("u", "", "S3 bucket URL to retrieve keys from")
-	urlFileFlag = flag.String("U", "", "File containing list of S3 bucket URLs")
-	threads     = flag.Int("t", 30, "Number of goroutines for downloading")
-	limit       = flag.Int("l", 50, "Limit of keys to retrieve from S3 bucket")
-	downloadKey = flag.String("d", "", "Download a single key")
-	downloadAll = flag.Bool("D", false, "Download all keys found")
-	filter      = flag.String("f", "", "Filter keys to display only those containing this substring")
-	debug       = flag.Bool("debug", false, "Show detailed error messages")
+	urlFlag            = flag.String("u", "", "S3 bucket URL to retrieve keys from")
+	urlFileFlag        = flag.String("U", "", "File containing list of S3 bucket URLs")
+	inputJSON          = flag.String("input-json", "", "Read the keys to work on from a JSON array or -json report instead of listing buckets (- for stdin)")
+	threads            = flag.Int("t", 30, "Number of goroutines for downloading")
+	concurrencyPerHost = flag.Int("concurrency-per-host", 0, "Maximum simultaneous downloads from one host (default: half of -t when downloading from several hosts)")
+	limit              = flag.Int("l", 50, "Limit of keys to retrieve from S3 bucket")
+	downloadKey        = flag.String("d", "", "Download a single key, or the listed keys at these indices of -index, e.g. 3,7,12 or 2-5")
+	downloadAll        = flag.Bool("D", false, "Download all keys found")
+	filter             = flag.String("f", "", "Filter keys to display only those containing this substring")
+	extensions         = flag.String("ext", "", "Only keep keys with one of these comma-separated extensions, e.g. txt,env,json (applies to downloads, -grep and -secrets too)")
+	noEmpty            = flag.Bool("no-empty", false, "Leave out zero-byte objects, such as directory markers, from the listing and downloads")
+	minKeyDepth        = flag.Int("min-key-depth", 0, "Only keep keys with at least this many /-separated segments, e.g. 3 for logs/2023/a.txt")
+	maxKeyDepth        = flag.Int("max-key-depth", 0, "Only keep keys with at most this many /-separated segments, 1 for top-level keys (0 means no limit)")
+	sampleSize         = flag.Int("sample", 0, "Show or download only this many keys, picked at random from the keys left after filtering (0 means all)")
+	sampleSeed         = flag.Int64("seed", 0, "Random seed of -sample, to pick the same keys again (0 picks a new seed, which is printed)")
+	debug              = flag.Bool("debug", false, "Show detailed error messages")
+	quiet              = flag.Bool("quiet", false, "Do not show listing and download progress on stderr")
+
+	// Listing
+	bucketLimit  = flag.Int("bucket-limit", 0, "Stop after listing this many buckets (0 means no limit)")
+	minKeys      = flag.Int("min-keys", 0, "Only report buckets that expose at least this many keys (0 means all)")
+	listVersion  = flag.Int("list-version", 1, "ListObjects API version to use: 1 (marker) or 2 (list-type=2, continuation-token)")
+	listMethod   = flag.String("list-method", "GET", "HTTP method of listing requests: GET, or POST to send the listing parameters as a form (for gateways that require it)")
+	startAfter   = flag.String("start-after", "", "Start listing after this key (start-after for -list-version 2, marker for 1)")
+	prefixesFile = flag.String("prefixes-file", "", "File of prefixes to list concurrently in each bucket, one per line")
+	listThreads  = flag.Int("lt", 5, "Number of prefixes listed concurrently with -prefixes-file")
+	ordered      = flag.Bool("ordered", false, "Hold back the messages of concurrent -prefixes-file listings and print them per prefix in input order (default when stderr is not a terminal)")
+	listParams   = newKeyValueFlag("list-param", "Extra key=value query parameter for listing requests (repeatable)")
+	listCacheDir = flag.String("list-cache", "", "Cache listing responses in this directory and reuse them on later runs")
+	listCacheTTL = flag.Duration("list-cache-ttl", time.Hour, "Maximum age of -list-cache entries that are reused (0 means no expiry)")
+	refreshCache = flag.Bool("refresh", false, "With -list-cache, list every bucket again and refresh the cached responses")
+	follow       = flag.Bool("follow", false, "Experimental: also list buckets referenced by redirect and error responses")
+	maxFollow    = flag.Int("max-follow", 2, "Maximum number of reference hops to follow with -follow")
+	onlyPublic   = flag.Bool("only-public", false, "Read the ACL of each bucket first and only list buckets whose ACL is public or cannot be read")
+	websiteCheck = flag.Bool("website", false, "Report the static website configuration of each bucket")
+	corsCheck    = flag.Bool("cors", false, "Report the CORS rules of each bucket")
+	tagsFlag     = flag.Bool("tags", false, "Read and print the tags of each bucket and listed object")
+	audit        = flag.Bool("audit", false, "Audit each bucket (listing, ACL, website, CORS, tags, SSE) and print a report instead of the listing; the modifying methods and write checks also need -audit-write")
+	auditSkip    = flag.String("audit-skip", "", "Comma-separated -audit checks to skip: listing, acl, website, cors, tags, methods, sse, write")
+	auditWrite   = flag.Bool("audit-write", false, "Also run the -audit checks that send modifying requests: methods (DELETE of a missing key) and write (PUT and DELETE of a probe object)")
+	dryRun       = flag.Bool("dry-run", false, "With -audit, print every request the audit would send and a summary by check and method, without sending any")
+	probeMethods = flag.String("probe-methods", "", "Comma-separated methods to test against each bucket: OPTIONS, POST, PUT, DELETE (POST, PUT and DELETE send modifying requests)")
+	probeHost    = flag.String("probe", "", "Probe common ports and paths of this host for an S3-compatible API and report the endpoints found")
+
+	// Output
+	treeFlag       = flag.Bool("tree", false, "Display keys as a directory tree")
+	noColor        = flag.Bool("no-color", false, "Draw -tree with ASCII connectors instead of box-drawing characters, as when NO_COLOR is set")
+	duFlag         = flag.Bool("du", false, "Report total size per prefix instead of listing keys")
+	duDepth        = flag.Int("du-depth", 1, "Number of prefix levels to aggregate sizes by with -du")
+	countFlag      = flag.Bool("count", false, "Print the number of keys found in each bucket instead of the keys")
+	emitFlag       = flag.String("emit", "", "Print a curl or wget command per key instead of the key (curl, wget)")
+	jsonOutput     = flag.Bool("json", false, "Write a versioned JSON report of the listed keys to stdout")
+	jsonPrettyFlag = flag.Bool("json-pretty", false, "Indent the -json report (default when stdout is a terminal)")
+	jsonCompact    = flag.Bool("json-compact", false, "Write the -json report on a single line (default when stdout is not a terminal)")
+	jsonOut        = flag.String("json-out", "", "Also write the JSON report to this file")
+	jsonByBucket   = flag.Bool("json-by-bucket", false, "Group the JSON report by bucket URL, each bucket with its listing and keys, instead of flat buckets and objects arrays")
+	diffFile       = flag.String("diff", "", "Compare the listing with this earlier -json report and print the added, removed and changed keys")
+	watchInterval  = flag.Duration("watch", 0, "List the buckets again at this interval and print the keys added, removed or changed since the previous listing, until interrupted")
+	webhook        = flag.String("webhook", "", "POST a JSON notification to this URL when keys appear with -diff or -watch, or -audit finds high-severity issues")
+	keysOut        = flag.String("of", "", "Also write the listed keys to this file, one per line")
+	rawOutput      = flag.Bool("raw", false, "Print only the key or URL on each line, without the \"Key:\" prefix")
+	showIndex      = flag.Bool("index", false, "Number the listed keys from 1, to pick them by index with -d, e.g. -d 3,7,12")
+	pagerFlag      = flag.Bool("pager", false, "Show the listing through $PAGER, or less, when stdout is a terminal")
+	summaryJSON    = flag.Bool("summary-json", false, "Print a one-line JSON summary of the run (keys, downloads, bytes, errors, elapsed time) as the last line of stdout")
+	decodeBase64   = flag.Bool("decode-base64", false, "Show base64-encoded key segments decoded in the key listing (display only)")
+	tuiFlag        = flag.Bool("tui", false, "Browse the listed keys interactively and pick keys or prefixes to download")
+
+	// Downloads
+	noOverwrite       = flag.Bool("no-overwrite", false, "Never overwrite existing local files")
+	skipExisting      = flag.Bool("skip-existing", false, "Do not download keys whose local file already exists (implies -no-overwrite)")
+	resumeFlag        = flag.Bool("resume", false, "Download through .part files and continue them with range requests when re-run")
+	byBucket          = flag.Bool("by-bucket", false, "Save downloads into a subdirectory per source bucket")
+	preservePaths     = flag.Bool("preserve-paths", false, "Save downloads under their full key path instead of the base name")
+	flatten           = flag.Bool("flatten", false, "Save downloads in one directory, named after their full key with / replaced by -flatten-separator")
+	flattenSeparator  = flag.String("flatten-separator", "__", "Separator that replaces / in the local names of -flatten")
+	normalizeKeys     = flag.Bool("normalize-keys", false, "Collapse duplicate slashes and strip leading slashes from keys before building local names")
+	nameTemplateFlag  = flag.String("name-template", "", "Go template for the local path of each download, e.g. {{.Host}}/{{.Key}}")
+	maxFilenameLength = flag.Int("max-filename-length", 255, "Shorten local file and directory names longer than this many bytes, keeping the extension (0 means no limit)")
+	followSymlinks    = flag.Bool("follow-symlinks", false, "Allow downloads to be written through existing symbolic links below the current directory")
+	metaFlag          = flag.Bool("meta", false, "Write the response headers of every download to a .meta JSON file next to it")
+	headAll           = flag.Bool("head-all", false, "Before -D, send HEAD requests for keys of unknown size to show byte-based progress")
+	splitThreshold    = flag.Int64("split-threshold", 64<<20, "Download keys of at least this many bytes as parallel byte ranges if the server supports them (0 disables)")
+	splitParts        = flag.Int("split-parts", 4, "Number of parallel byte ranges per key with -split-threshold")
+	limitPerExtension = flag.Int("limit-per-extension", 0, "With -D, download at most this many keys of each file extension (0 means no limit)")
+	confirmKeys       = flag.Int("confirm-keys", 1000, "Ask for confirmation before -D downloads more than this many keys (0 disables)")
+	confirmBytes      = flag.Int64("confirm-bytes", 1<<30, "Ask for confirmation before -D downloads more than this many bytes (0 disables)")
+	assumeYes         = flag.Bool("y", false, "Download without asking for confirmation, even above -confirm-keys or -confirm-bytes")
+	yesAlias          = newBoolAlias("yes", assumeYes, "Same as -y")
+	zipOut            = flag.String("zip", "", "With -D, write all downloads into this zip archive instead of individual files")
+	tarOut            = flag.String("tar", "", "With -D, write all downloads into this tar.gz archive instead of individual files")
+	failedOut         = flag.String("failed-out", "", "Write the URLs of failed downloads to this file")
+	stateFlag         = flag.String("state", "", "Record completed buckets and downloaded keys in this file and skip them when re-run")
+	failOnError       = flag.Bool("fail-on-error", false, "Stop at the first failed download and exit with status 3")
+	maxBucketErrors   = flag.Int("max-errors-per-bucket", 0, "Skip the remaining keys of a bucket after this many of its downloads failed in a row, recording them as failed (0 means no limit)")
+	retryFailed       = flag.String("retry-failed", "", "Retry the downloads listed in a -failed-out file")
+	presignedFile     = flag.String("presigned", "", "Download the presigned URLs listed in this file, one per line, without listing")
+	byteRange         = flag.String("range", "", "With -d, download only this byte range of the key, e.g. bytes=0-1023")
+	gunzip            = flag.Bool("gunzip", false, "Decompress .gz and .tgz keys and Content-Encoding: gzip responses while downloading, saving them without .gz")
+	compressDownload  = newBoolAlias("compress-download", gunzip, "Same as -gunzip")
+	keepCompressed    = flag.Bool("keep-compressed", false, "Save downloads exactly as stored, without decompressing Content-Encoding: gzip responses as the HTTP client otherwise does")
+	renameExt         = newExtensionMapFlag("rename-ext", "Comma-separated .from=.to extension rewrites for local file names, e.g. .bin=.jpg (repeatable)")
+	grepPattern       = flag.String("grep", "", "Match this regular expression against the lines of object bodies and print the matching lines: while downloading with -D or -d, otherwise without saving anything")
+	secretsFlag       = flag.Bool("secrets", false, "Scan object bodies for credentials such as AWS keys, private keys and API tokens: while downloading with -D or -d, otherwise without saving anything")
+	secretsRedact     = flag.String("secrets-redact", "partial", "How -secrets shows the secrets it finds: partial (first and last characters), full (rule name only) or none")
+
+	// HTTP
+	jitter           = flag.Duration("jitter", 0, "Wait a random delay up to this duration (e.g. 500ms) before each request")
+	throttleOn429    = flag.Bool("throttle-on-429", false, "Halve the concurrent requests after a 429 and raise them again gradually")
+	requestTimeout   = flag.Duration("timeout", 0, "Timeout for each HTTP request, including reading the response body (0 means no timeout)")
+	stallTimeout     = flag.Duration("stall-timeout", 0, "Abort and download a key again, or resume it with -resume, when it receives no data for this long, up to -retries times (0 disables)")
+	connectTimeout   = flag.Duration("connect-timeout", 5*time.Second, "Give up connecting to a host after this duration (0 for the system default)")
+	maxRedirects     = flag.Int("max-redirects", 10, "Maximum number of redirects to follow per request")
+	retries          = flag.Int("retries", 2, "Number of times to retry requests that failed with a network error or a -retry-status status")
+	retryBudgetFlag  = flag.Int("retry-budget", 0, "Maximum number of retries across the whole run, after which failed requests are not retried (0 means no limit)")
+	retryStatus      = newStatusListFlag("retry-status", []int{429, 500, 502, 503, 504}, "Comma-separated HTTP status codes to retry")
+	maxIdleConns     = flag.Int("max-idle-conns", 0, "Maximum idle connections kept open across all hosts (0 means the larger of 100 and twice -t)")
+	maxConnsPerHost  = flag.Int("max-conns-per-host", 0, "Maximum connections per host, including active ones (0 means no limit)")
+	disableKeepAlive = flag.Bool("disable-keepalive", false, "Open a new connection for every request")
+	caCert           = flag.String("ca-cert", "", "PEM file of CA certificates to trust in addition to the system roots, e.g. for an internal CA or intercepting proxy")
+	clientCert       = flag.String("client-cert", "", "PEM file of the client certificate to present to endpoints that require mutual TLS (with -client-key)")
+	clientKey        = flag.String("client-key", "", "PEM file of the private key of -client-cert")
+	sniFlag          = flag.String("sni", "", "TLS server name to send and verify instead of the URL host: a name for every host, or comma-separated host=name pairs")
+	dnsResolver      = flag.String("dns-resolver", "", "Resolve hosts with this DNS server (ip[:port]) or DNS-over-HTTPS JSON endpoint (https://...)")
+	ipv4Only         = flag.Bool("4", false, "Connect over IPv4 only")
+	ipv6Only         = flag.Bool("6", false, "Connect over IPv6 only")
+	trace            = flag.Bool("trace", false, "Log every HTTP request and response to stderr")
+	traceOut         = flag.String("trace-out", "", "Write the HTTP trace to this file instead of stderr")
+	metricsAddr      = flag.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9100) while running")
+	bench            = flag.Bool("bench", false, "Benchmark downloading the listed keys at several -t values with and without keepalive")
+
+	// Request signing
+	profile      = flag.String("profile", "", "AWS shared config profile to sign requests with")
+	accessKey    = flag.String("access-key", "", "AWS access key ID to sign requests with")
+	secretKey    = flag.String("secret-key", "", "AWS secret access key to sign requests with")
+	sessionToken = flag.String("session-token", "", "AWS session token for temporary credentials (default: $AWS_SESSION_TOKEN with -access-key, the profile's token with -profile)")
+	region       = flag.String("region", "", "Region used for request signing (default: derived from the endpoint)")
+)
+
+// Progress bar layouts of downloadAllKeys, by bytes or by keys
+const (
+	byteProgressBar pb.ProgressBarTemplate = `{{counters . }} {{bar . }} {{percent . }} {{speed . "%s/s" "? B/s"}} {{rtime . "ETA %s" "in %s"}}`
+	keyProgressBar  pb.ProgressBarTemplate = `{{counters . }} keys {{bar . }} {{percent . }} {{speed . "%s keys/s" "? keys/s"}} {{rtime . "ETA %s" "in %s"}}`
+)
+
+// Exit codes
+const (
+	exitOK              = 0
+	exitBucketsFailed   = 2 // at least one bucket could not be listed
+	exitDownloadsFailed = 3 // a download failed with -fail-on-error
 )
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
+	runTotals.start = time.Now()
+	code := run()
+	// Printed last, so CI can read the final figures with tail -1
+	if *summaryJSON {
+		writeRunSummary(os.Stdout, code)
+	}
+	os.Exit(code)
+}
 
-	if *urlFlag == "" && *urlFileFlag == "" {
-		log.Fatal("Either -u or -U must be specified")
+// run executes the command selected by the flags and returns the process exit code
+func run() int {
+	if *metricsAddr != "" {
+		stopMetrics := startMetricsServer(*metricsAddr)
+		defer stopMetrics()
 	}
 
-	var keys []string
-	if *urlFlag != "" {
-		keys = getS3Keys(*urlFlag, *limit, *urlFlag)
-	} else if *urlFileFlag != "" {
-		urls := readURLsFromFile(*urlFileFlag)
-		for _, bucketURL := range urls {
-			keys = append(keys, getS3Keys(bucketURL, *limit, bucketURL)...)
+	if *nameTemplateFlag != "" {
+		parseNameTemplate(*nameTemplateFlag)
+	}
+
+	if *presignedFile != "" {
+		configureHTTPClient()
+		openOutputArchive()
+		downloadPresignedURLs(*presignedFile)
+		closeOutputArchive()
+		if *failOnError && failedDownloadCount() > 0 {
+			return exitDownloadsFailed
 		}
+		return exitOK
+	}
+
+	if *retryFailed != "" {
+		configureHTTPClient()
+		openOutputArchive()
+		retryFailedDownloads(*retryFailed)
+		closeOutputArchive()
+		if *failOnError && failedDownloadCount() > 0 {
+			return exitDownloadsFailed
+		}
+		return exitOK
+	}
+
+	if *probeHost != "" {
+		configureHTTPClient()
+		return probeEndpoints(*probeHost)
+	}
+
+	if *urlFlag == "" && *urlFileFlag == "" && *inputJSON == "" {
+		log.Fatal("Either -u, -U, -input-json or -probe must be specified")
+	}
+	if *jsonPrettyFlag && *jsonCompact {
+		log.Fatal("Only one of -json-pretty and -json-compact can be specified")
+	}
+	if *listVersion != 1 && *listVersion != 2 {
+		log.Fatal("-list-version must be 1 or 2")
+	}
+	if *emitFlag != "" && !slices.Contains(emitTools, *emitFlag) {
+		log.Fatalf("-emit must be one of %s", strings.Join(emitTools, ", "))
+	}
+	if *listMethod = strings.ToUpper(*listMethod); *listMethod != http.MethodGet && *listMethod != http.MethodPost {
+		log.Fatal("-list-method must be GET or POST")
+	}
+	if *flatten {
+		if *preservePaths {
+			log.Fatal("Only one of -flatten and -preserve-paths can be specified")
+		}
+		if *flattenSeparator == "" || strings.ContainsAny(*flattenSeparator, `/\`) {
+			log.Fatal("-flatten-separator must not be empty or contain a slash")
+		}
+	}
+	if *byteRange != "" {
+		if *downloadKey == "" {
+			log.Fatal("-range can only be used with -d")
+		}
+		if *zipOut != "" || *tarOut != "" {
+			log.Fatal("-range cannot be combined with -zip or -tar")
+		}
+		normalized, err := parseByteRange(*byteRange)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*byteRange = normalized
+	}
+	var err error
+	if auditSkipped, err = parseAuditSkip(*auditSkip); err != nil {
+		log.Fatal(err)
+	}
+	if probedMethods, err = parseProbeMethods(*probeMethods); err != nil {
+		log.Fatal(err)
+	}
+	keptExtensions = parseExtensions(*extensions)
+	if *grepPattern != "" {
+		if grepRegexp, err = regexp.Compile(*grepPattern); err != nil {
+			log.Fatalf("Invalid -grep: %v", err)
+		}
+	}
+	if *secretsRedact = strings.ToLower(*secretsRedact); !slices.Contains(redactModes, *secretsRedact) {
+		log.Fatalf("-secrets-redact must be one of %s", strings.Join(redactModes, ", "))
+	}
+	if scanningBodies() && (*resumeFlag || *byteRange != "") {
+		log.Fatal("-grep and -secrets cannot be combined with -resume or -range")
+	}
+	if *gunzip {
+		if *keepCompressed {
+			log.Fatal("Only one of -gunzip and -keep-compressed can be specified")
+		}
+		if *resumeFlag || *byteRange != "" {
+			log.Fatal("-gunzip cannot be combined with -resume or -range")
+		}
+	}
+	if *watchInterval > 0 && (*downloadAll || *downloadKey != "" || *tuiFlag || *jsonOutput || *stateFlag != "" ||
+		*listCacheDir != "" || *inputJSON != "" || *sampleSize > 0 || *audit || scanningBodies()) {
+		log.Fatal("-watch cannot be combined with -D, -d, -tui, -json, -state, -list-cache, -input-json, -sample, -audit, -grep or -secrets")
+	}
+	if *webhook != "" {
+		if u, err := url.Parse(*webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("-webhook must be an http:// or https:// URL")
+		}
+	}
+	if *watchInterval < 0 {
+		log.Fatal("-watch must be a positive interval")
+	}
+	if *sampleSize > 0 && *downloadKey != "" {
+		log.Fatal("-sample cannot be combined with -d")
+	}
+	if *maxKeyDepth > 0 && *minKeyDepth > *maxKeyDepth {
+		log.Fatal("-min-key-depth must not be greater than -max-key-depth")
+	}
+	if *listThreads < 1 {
+		log.Fatal("-lt must be at least 1")
+	}
+	if *maxFilenameLength < 0 || *maxFilenameLength > 0 && *maxFilenameLength < minFilenameLength {
+		log.Fatalf("-max-filename-length must be 0 or at least %d", minFilenameLength)
+	}
+	if *auditWrite && !*audit {
+		log.Fatal("-audit-write can only be used with -audit")
+	}
+	if *dryRun {
+		if !*audit {
+			log.Fatal("-dry-run can only be used with -audit")
+		}
+		printAuditPlan(os.Stdout, bucketURLs(), readPrefixes())
+		return exitOK
+	}
+	if *stateFlag != "" {
+		if state, err = loadState(*stateFlag); err != nil {
+			log.Fatal(err)
+		}
+		state.saveOnSignal()
+	}
+	if *listCacheDir != "" {
+		if listCache, err = openListCache(*listCacheDir, *listCacheTTL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var previous []s3Object
+	if *diffFile != "" {
+		if previous, err = readInputJSON(*diffFile); err != nil {
+			log.Fatalf("Invalid -diff: %v", err)
+		}
+	}
+	configureHTTPClient()
+	if *watchInterval > 0 {
+		return watchBuckets(os.Stdout, *watchInterval, filterObjects(scopeObjects(previous)))
+	}
+
+	var objects []s3Object
+	var listings []bucketListing
+	if *inputJSON != "" {
+		if objects, err = readInputJSON(*inputJSON); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		objects, listings = collectObjects()
+	}
+
+	objects = scopeObjects(objects)
+	matched := filterObjects(objects)
+	if *diffFile != "" {
+		listingChanges = diffListings(*diffFile, filterObjects(scopeObjects(previous)), matched, listings)
+		notifyNewKeys(listingChanges)
+	}
+	if *audit {
+		notifyAuditFindings()
+	}
+
+	if *sampleSize > 0 {
+		// Downloads work on the sample too
+		matched = sampleObjects(matched, *sampleSize)
+		objects = matched
+	}
+
+	recordListings(listings, matched)
+
+	if *bench {
+		return runBench(matched)
+	}
+
+	if *tagsFlag {
+		readObjectTags(matched)
+	}
+
+	downloading := *downloadKey != "" || *downloadAll || *tuiFlag
+	if scanningBodies() && !downloading {
+		scanBodies(matched, *threads)
 	}
 
 	// Only show the list of keys if -d and -D are not used
-	if *downloadKey == "" && !*downloadAll {
-		for _, key := range keys {
-			if *filter == "" || strings.Contains(key, *filter) {
-				fmt.Println("Key:", key)
+	if *downloadKey == "" && !*downloadAll && !*jsonOutput && !*tuiFlag {
+		out, closePager := openPager()
+		if *audit {
+			printAudits(out)
+		} else if listingChanges != nil {
+			listingChanges.print(out)
+		} else if scanningBodies() {
+			printScanResults(out, matched)
+		} else if *duFlag {
+			printDiskUsage(out, matched, *duDepth)
+		} else if *treeFlag {
+			printKeyTree(out, matched)
+		} else if *countFlag {
+			printKeyCounts(out, matched, listings)
+		} else if *emitFlag != "" {
+			printDownloadCommands(out, *emitFlag, matched)
+		} else {
+			for i, object := range matched {
+				if *rawOutput {
+					if *showIndex {
+						fmt.Fprintf(out, "%d\t%s\n", i+1, object.displayKey())
+					} else {
+						fmt.Fprintln(out, object.displayKey())
+					}
+					continue
+				}
+				key := object.displayKey()
+				if *decodeBase64 {
+					if decoded, ok := decodeBase64Key(key); ok {
+						key = decoded + " (base64: " + key + ")"
+					}
+				}
+				if *showIndex {
+					fmt.Fprintf(out, "[%d] Key: %s\n", i+1, key)
+				} else {
+					fmt.Fprintln(out, "Key:", key)
+				}
 			}
 		}
+		closePager()
 	}
 
+	// The keys picked with -d are looked up before anything is downloaded
+	resumable := objects
 	if *downloadKey != "" {
-		downloadSingleKey(*urlFlag, *downloadKey)
+		selected, byIndex, err := selectByIndex(matched, objects, *downloadKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !byIndex {
+			selected = []s3Object{singleKeyObject(objects, *downloadKey)}
+		}
+		if len(selected) > 1 && *byteRange != "" {
+			log.Fatal("-range can only be used with a single key")
+		}
+		resumable = selected
+	}
+	if downloading {
+		openOutputArchive()
+		if *resumeFlag && outputArchive == nil {
+			scanPartialDownloads(".", resumable)
+		}
+	}
+	if *downloadKey != "" {
+		for _, object := range resumable {
+			downloadObject(object)
+		}
 	} else if *downloadAll {
-		downloadAllKeys(*urlFlag, keys, *threads)
+		downloadAllKeys(objects, *threads)
+	} else if *tuiFlag {
+		browseKeys(os.Stdin, os.Stdout, matched)
 	}
+	closeOutputArchive()
+	if *failedOut != "" && downloading {
+		writeFailedDownloads(*failedOut)
+	}
+	if scanningBodies() && downloading && !*jsonOutput {
+		printScanResults(os.Stdout, objects)
+	}
+	state.markBuckets(listings, *downloadAll)
+	state.save()
+
+	// The JSON report is written last so it can follow the progress of downloads
+	if *jsonOutput {
+		if err := writeJSONReport(os.Stdout, matched, listings); err != nil {
+			log.Fatalf("Failed to write JSON report: %v", err)
+		}
+	}
+	writeReportOutputs(matched, listings)
+
+	if printListingSummary(os.Stderr, listings) {
+		return exitBucketsFailed
+	}
+	if *failOnError && failedDownloadCount() > 0 {
+		return exitDownloadsFailed
+	}
+	return exitOK
 }
 
-// debugLog logs a message only if the --debug flag is set
-func debugLog(format string, v ...interface{}) {
-	if *debug {
-		log.Printf(format, v...)
+// scopeObjects drops the objects excluded by -no-empty, -min-key-depth,
+// -max-key-depth and -ext. Unlike -f, which only narrows what is shown, these filters
+// apply to downloads too.
+func scopeObjects(objects []s3Object) []s3Object {
+	kept := objects[:0:0]
+	for _, object := range objects {
+		// Zero-byte keys are mostly directory markers; keys of unknown size are kept
+		if *noEmpty && object.Size == 0 {
+			continue
+		}
+		depth := keyDepth(object.Key)
+		if depth < *minKeyDepth || (*maxKeyDepth > 0 && depth > *maxKeyDepth) {
+			continue
+		}
+		if keptExtensions != nil && !keptExtensions[keyExtension(object.Key)] {
+			continue
+		}
+		kept = append(kept, object)
 	}
+	return kept
 }
 
-// getS3Keys fetches S3 keys from a bucket URL and parses XML response
-// If XML parsing fails, logs the error and skips to the next URL if -U is set.
-func getS3Keys(bucketURL string, limit int, prefix string) []string {
-	resp, err := http.Get(bucketURL)
-	if err != nil {
-		debugLog("Failed to retrieve keys from %s: %v", bucketURL, err)
+// keptExtensions is the set of -ext extensions, with their dot, or nil without -ext
+var keptExtensions map[string]bool
+
+// parseExtensions parses the comma-separated extensions of -ext, with or
+// without a leading dot, into a lower-cased set
+func parseExtensions(list string) map[string]bool {
+	if list == "" {
 		return nil
 	}
-	defer resp.Body.Close()
+	set := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+			set["."+strings.TrimPrefix(ext, ".")] = true
+		}
+	}
+	if len(set) == 0 {
+		log.Fatal("-ext must list at least one extension")
+	}
+	return set
+}
 
-	if resp.StatusCode != http.StatusOK {
-		debugLog("Failed to retrieve keys from %s, status code: %d", bucketURL, resp.StatusCode)
-		return nil
+// openOutputArchive starts the archive selected with -zip or -tar, if any
+func openOutputArchive() {
+	switch {
+	case *zipOut != "" && *tarOut != "":
+		log.Fatal("Only one of -zip and -tar can be specified")
+	case *zipOut != "":
+		outputArchive = openArchive(*zipOut, newZipArchive)
+	case *tarOut != "":
+		outputArchive = openArchive(*tarOut, newTarArchive)
 	}
+}
 
-	// Read and parse the XML response to retrieve keys
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		debugLog("Error reading response body from %s: %v", bucketURL, err)
-		return nil
+// closeOutputArchive finalizes the archive once all downloads are done
+func closeOutputArchive() {
+	if outputArchive != nil {
+		outputArchive.close()
+		outputArchive = nil
+	}
+}
+
+// skippedExisting counts downloads skipped because the local file already exists
+var skippedExisting atomic.Int64
+
+// bucketTarget is a bucket URL queued for listing
+type bucketTarget struct {
+	url   string
+	depth int // number of -follow hops from a user-provided URL
+}
+
+// filterObjects returns the objects whose displayed key contains -f
+func filterObjects(objects []s3Object) []s3Object {
+	var matched []s3Object
+	for _, object := range objects {
+		if *filter == "" || strings.Contains(object.displayKey(), *filter) {
+			matched = append(matched, object)
+		}
 	}
+	return matched
+}
 
-	var result ListBucketResult
-	if err := xml.Unmarshal(rawData, &result); err != nil {
-		debugLog("Error parsing XML from %s: %v. Skipping to the next URL.", bucketURL, err)
+// bucketURLs returns the bucket URLs given with -u or -U
+func bucketURLs() []string {
+	if *urlFlag != "" {
+		return []string{*urlFlag}
+	} else if *urlFileFlag != "" {
+		return readLines(*urlFileFlag)
+	}
+	return nil
+}
+
+// readPrefixes returns the prefixes of -prefixes-file, or nil without it
+func readPrefixes() []string {
+	if *prefixesFile == "" {
 		return nil
 	}
+	var prefixes []string
+	for _, prefix := range readLines(*prefixesFile) {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		log.Fatalf("No prefixes found in %s", *prefixesFile)
+	}
+	return prefixes
+}
+
+// collectObjects lists every bucket given with -u or -U. With -follow, buckets
+// referenced by the responses are queued too, up to -max-follow hops away.
+// With -bucket-limit, listing stops once that many buckets were processed.
+// It returns the keys of all buckets along with the listing of each bucket.
+func collectObjects() ([]s3Object, []bucketListing) {
+	var queue []bucketTarget
+	for _, bucketURL := range bucketURLs() {
+		queue = append(queue, bucketTarget{url: bucketURL})
+	}
+	prefixes := readPrefixes()
 
-	// Extract keys up to the specified limit, prepending with the bucket URL if -U is used
-	var keys []string
-	for i, content := range result.Contents {
-		if i >= limit {
+	var objects []s3Object
+	var listings []bucketListing
+	belowMinKeys := 0
+	visited := make(map[string]bool)
+	for len(queue) > 0 {
+		if *bucketLimit > 0 && len(listings) >= *bucketLimit {
+			log.Printf("Stopping after %d buckets (-bucket-limit), %d not processed", len(listings), len(queue))
 			break
 		}
-		key := content.Key
-		// If -U is set, prepend the bucket URL to each key
-		if *urlFileFlag != "" {
-			key = fmt.Sprintf("%s/%s", bucketURL, key)
+		target := queue[0]
+		queue = queue[1:]
+		if visited[target.url] {
+			continue
+		}
+		visited[target.url] = true
+		if state.bucketDone(target.url) {
+			log.Printf("Skipping %s, it was completed according to %s", target.url, *stateFlag)
+			continue
+		}
+
+		if !auditBucket(target.url) {
+			continue
+		}
+
+		var listing bucketListing
+		listProgress.start(target.url)
+		if len(prefixes) > 0 {
+			listing = listPrefixes(target.url, prefixes, *limit)
+		} else {
+			listing = listBucket(target.url, "", *limit, nil)
+		}
+		listProgress.done()
+		// Buckets cut off by -l hold more keys than were counted, so they are kept
+		if *minKeys > 0 && (listing.Status == listingOK || listing.Status == listingEmpty) &&
+			listing.KeyCount < *minKeys && !listing.Truncated {
+			debugLog("Not reporting %s, it has %d keys (-min-keys %d)", target.url, listing.KeyCount, *minKeys)
+			belowMinKeys++
+		} else {
+			objects = append(objects, listing.Objects...)
+		}
+		listings = append(listings, listing)
+		auditListing(listing)
+
+		if !*follow || target.depth >= *maxFollow {
+			continue
+		}
+		for _, referral := range listing.Referrals {
+			if !visited[referral] {
+				log.Printf("Following reference from %s to %s", target.url, referral)
+				queue = append(queue, bucketTarget{url: referral, depth: target.depth + 1})
+			}
+		}
+	}
+
+	if *bucketLimit > 0 {
+		for _, listing := range listings {
+			fmt.Fprintf(os.Stderr, "Processed bucket: %s\n", listing.URL)
+		}
+	}
+	if belowMinKeys > 0 {
+		fmt.Fprintf(os.Stderr, "%d buckets with fewer than %d keys not reported (-min-keys)\n", belowMinKeys, *minKeys)
+	}
+	return objects, listings
+}
+
+// debugLog logs a message only if the --debug flag is set
+func debugLog(format string, v ...interface{}) {
+	if *debug {
+		log.Printf(format, v...)
+	}
+}
+
+// singleKeyObject returns the object of a single key given with -d. The key is
+// looked up in the listed objects (by key or by the full URL shown with -U) so
+// it is fetched from the bucket it was listed in; otherwise it is fetched from
+// the -u bucket.
+func singleKeyObject(objects []s3Object, key string) s3Object {
+	object, ok := findObject(objects, key)
+	if !ok {
+		if *urlFlag == "" {
+			log.Fatalf("Key %s was not found in any bucket listed from %s", key, *urlFileFlag)
 		}
-		keys = append(keys, key)
+		object = s3Object{Bucket: *urlFlag, Key: key, Size: -1}
 	}
+	return object
+}
 
-	return keys
+// downloadObject downloads one object picked with -d, or the -range of it
+func downloadObject(object s3Object) {
+	if *byteRange != "" {
+		downloadRange(object, *byteRange)
+		return
+	}
+	if downloadAndSave(object, nil) {
+		fmt.Printf("Downloaded %s\n", object.displayKey())
+	} else {
+		log.Printf("Failed to download %s", object.url())
+	}
 }
 
-// downloadSingleKey downloads a single key from the bucket URL
-func downloadSingleKey(bucketURL, key string) {
-	url := fmt.Sprintf("%s/%s", bucketURL, key)
-	downloadAndSave(url, key)
-	fmt.Printf("Downloaded %s\n", key)
+// findObject returns the listed object matching a key or a full object URL
+func findObject(objects []s3Object, key string) (s3Object, bool) {
+	for _, object := range objects {
+		if object.Key == key || object.url() == key {
+			return object, true
+		}
+	}
+	return s3Object{}, false
 }
 
-// downloadAllKeys downloads all specified keys concurrently with a progress bar
-func downloadAllKeys(bucketURL string, keys []string, threads int) {
-	bar := pb.StartNew(len(keys))
+// downloadAllKeys downloads all specified objects concurrently with a progress bar.
+// Objects from every bucket share one pool of at most threads downloads, of
+// which at most -concurrency-per-host go to the same host.
+// When the size of every object is known the bar tracks bytes, otherwise keys.
+func downloadAllKeys(objects []s3Object, threads int) {
+	var extensionCounts map[string][2]int
+	if *limitPerExtension > 0 {
+		objects, extensionCounts = sampleByExtension(objects, *limitPerExtension)
+	}
+	if *downloadAll {
+		confirmDownloads(objects)
+	}
+	if *headAll {
+		headSizes(objects, threads)
+	}
+	totalBytes, byteProgress := totalSize(objects)
+	if outputArchive != nil {
+		assignUniquePaths(objects, renderArchiveName)
+	} else {
+		assignUniquePaths(objects, renderLocalPath)
+	}
+
+	// The rate and ETA follow the recent throughput (pb averages the speed);
+	// when sizes are unknown they are in keys rather than bytes
+	var bar *pb.ProgressBar
+	if byteProgress {
+		bar = pb.New64(totalBytes).SetTemplate(byteProgressBar)
+		bar.Set(pb.Bytes, true)
+	} else {
+		bar = pb.New(len(objects)).SetTemplate(keyProgressBar)
+	}
 	bar.Set(pb.SIBytesPrefix, true)
+	if *quiet {
+		bar.SetWriter(io.Discard)
+	}
+	bar.Start()
 
-	sem := make(chan struct{}, threads)
+	var mu sync.Mutex
+	downloaded := make(map[string]int)
+	total := make(map[string]int)
+	var buckets []string
+	for _, object := range objects {
+		if _, ok := total[object.Bucket]; !ok {
+			buckets = append(buckets, object.Bucket)
+		}
+		total[object.Bucket]++
+	}
+
+	scheduler := newHostScheduler(objects, threads, perHostLimit(objects, threads))
 	var wg sync.WaitGroup
-	for _, key := range keys {
+	notAttempted := 0
+	for {
+		object, ok := scheduler.take()
+		if !ok {
+			break
+		}
+		// With -fail-on-error no download is started once one has failed
+		if *failOnError && failedDownloadCount() > 0 {
+			scheduler.done(object)
+			notAttempted = scheduler.remaining() + 1
+			break
+		}
 		wg.Add(1)
-		sem <- struct{}{}
-		go func(k string) {
+		go func(o s3Object) {
 			defer wg.Done()
-			url := fmt.Sprintf("%s/%s", bucketURL, k)
-			downloadAndSave(url, k)
-			bar.Increment()
-			<-sem
-		}(key)
+			defer scheduler.done(o)
+			var progress func(int64)
+			var read int64
+			if byteProgress {
+				progress = func(n int64) {
+					read += n
+					bar.Add64(n)
+				}
+			}
+			if breaker.skip(o) {
+				recordFailedDownload(o)
+			} else if downloadAndSave(o, progress) {
+				breaker.success(o)
+				mu.Lock()
+				downloaded[o.Bucket]++
+				mu.Unlock()
+			}
+			if byteProgress {
+				// Account for skipped, failed or short downloads so the bar still completes
+				if read < o.Size {
+					bar.Add64(o.Size - read)
+				}
+			} else {
+				bar.Increment()
+			}
+		}(object)
 	}
 	wg.Wait()
 	bar.Finish()
+	breaker.report()
+
+	if notAttempted > 0 {
+		log.Printf("Stopped after a failed download (-fail-on-error), %d keys were not attempted", notAttempted)
+	}
+	if state != nil && state.skipped.Load() > 0 {
+		fmt.Printf("Skipped %d keys already downloaded according to %s\n", state.skipped.Load(), *stateFlag)
+	}
+	if n := skippedExisting.Load(); n > 0 {
+		fmt.Printf("Skipped %d keys whose local file already exists\n", n)
+	}
+	if !*jsonOutput {
+		printContentTypeSummary(os.Stdout)
+		printExtensionSummary(os.Stdout, extensionCounts)
+	}
+
+	// Attribute the downloads to their source buckets when several were scanned
+	if len(buckets) > 1 {
+		for _, bucket := range buckets {
+			fmt.Printf("Downloaded %d/%d keys from %s\n", downloaded[bucket], total[bucket], bucket)
+		}
+	}
+}
+
+// downloadAndSave handles the downloading and saving of an object.
+// It reports whether the file was saved; failed downloads are recorded for -failed-out.
+// If progress is not nil it is called with the number of bytes of every read.
+func downloadAndSave(object s3Object, progress func(int64)) bool {
+	url := object.url()
+	if state.keyDone(object) {
+		debugLog("Skipping %s, it was downloaded according to %s", url, *stateFlag)
+		state.skipped.Add(1)
+		return true
+	}
+	localFile := localPath(object)
+	if *skipExisting && outputArchive == nil {
+		if _, err := os.Stat(localFile); err == nil {
+			debugLog("Skipping %s, %s already exists", url, localFile)
+			skippedExisting.Add(1)
+			return false
+		}
+	}
+
+	// A HEAD earlier in the run already showed the key does not exist. Any
+	// other status is no sign the GET fails: servers may not allow HEAD, and
+	// presigned URLs are signed for GET only, so HEAD gets 403.
+	if head, ok := cachedHead(url); ok && head.StatusCode == http.StatusNotFound && object.Query == "" {
+		debugLog("Failed to download %s, HEAD status code: %d", url, head.StatusCode)
+		recordFailedDownload(object)
+		return false
+	}
+
+	for attempt := 0; ; attempt++ {
+		ok, stalled := fetchObject(object, localFile, progress)
+		if !stalled {
+			return ok
+		}
+		if attempt >= *retries {
+			log.Printf("Download of %s stalled %d times (-stall-timeout), giving up", url, attempt+1)
+			recordFailedDownload(object)
+			return false
+		}
+		if outputArchive == nil && *resumeFlag {
+			log.Printf("Download of %s received nothing for %s (-stall-timeout), resuming it", url, *stallTimeout)
+		} else {
+			log.Printf("Download of %s received nothing for %s (-stall-timeout), downloading it again", url, *stallTimeout)
+		}
+	}
+}
+
+// fetchObject downloads an object once: through a .part file with -resume, in
+// -split-parts ranges if it is large enough, otherwise with a single GET.
+// stalled is true if -stall-timeout canceled the download.
+func fetchObject(object s3Object, localFile string, progress func(int64)) (ok, stalled bool) {
+	if outputArchive == nil && *resumeFlag {
+		return resumeDownload(object, localFile, progress)
+	}
+	// -grep, -secrets and -gunzip process the body as it is saved, which needs it in one piece
+	if outputArchive == nil && *splitThreshold > 0 && *splitParts > 1 && !scanningBodies() && !*gunzip {
+		if handled, ok, stalled := splitDownload(object, localFile, progress); handled {
+			return ok, stalled
+		}
+	}
+	return fetchAndSave(object, localFile, progress)
 }
 
-// downloadAndSave handles the downloading and saving of a file from a URL
-func downloadAndSave(url, key string) {
-	resp, err := http.Get(url)
+// fetchAndSave downloads an object with a single GET and saves it. stalled is
+// true if -stall-timeout canceled the download; the partial file is then
+// removed and its bytes are taken back from the progress, and the failure is
+// left to the caller, which may try again.
+func fetchAndSave(object s3Object, localFile string, progress func(int64)) (ok, stalled bool) {
+	url := object.url()
+	ctx, cancel, watch := newStallWatch(context.Background(), *stallTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		debugLog("Failed to download key %s: %v", key, err)
-		return
+		debugLog("Failed to download %s: %v", url, err)
+		recordFailedDownload(object)
+		return false, false
+	}
+	setAcceptEncoding(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if watch.fired() {
+			return false, true
+		}
+		debugLog("Failed to download %s: %v", url, err)
+		recordFailedDownload(object)
+		return false, false
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		debugLog("Failed to download key %s, status code: %d", key, resp.StatusCode)
-		return
+		debugLog("Failed to download %s, status code: %d", url, resp.StatusCode)
+		recordFailedDownload(object)
+		return false, false
 	}
 
-	saveToFile(key, resp.Body)
+	// Progress counts the bytes received, the content type and -grep see the
+	// content as it is saved
+	var written int64
+	received := &progressReader{r: watch.reader(resp.Body), progress: func(n int64) {
+		written += n
+		if progress != nil {
+			progress(n)
+		}
+	}}
+	content, err := decompressedBody(object, resp, received)
+	if err != nil {
+		debugLog("Failed to decompress %s: %v", url, err)
+		recordFailedDownload(object)
+		return false, false
+	}
+	sniffer := &sniffReader{r: content}
+	var body io.Reader = sniffer
+	scanner := newBodyScanner()
+	if scanner != nil {
+		body = io.TeeReader(sniffer, scanner)
+	}
+	if outputArchive != nil {
+		err = saveToArchive(object, resp, body)
+	} else {
+		err = saveToFile(localFile, body)
+	}
+	if err != nil && watch.fired() {
+		debugLog("Download of %s stalled after %d bytes", url, written)
+		if outputArchive == nil {
+			os.Remove(localFile)
+		}
+		if progress != nil {
+			progress(-written)
+		}
+		return false, true
+	}
+	if err != nil {
+		if outputArchive != nil || !errors.Is(err, fs.ErrExist) {
+			recordFailedDownload(object)
+		}
+		return false, false
+	}
+	recordContentType(object, resp.Header.Get("Content-Type"), sniffer.head)
+	recordEncryption(object, resp.Header)
+	scanner.record(object)
+	if *metaFlag {
+		writeMetadata(object, localFile, resp.Header)
+	}
+	state.markKey(object)
+	recordDownload(written)
+	return true, false
 }
 
-// saveToFile saves the downloaded content to a file
-func saveToFile(key string, content io.Reader) {
-	localFile := filepath.Base(key)
-	file, err := os.Create(localFile)
+// saveToFile saves the downloaded content to a file, creating its directory if needed.
+// With -no-overwrite (or -skip-existing) an existing file is left untouched and
+// an error wrapping fs.ErrExist is returned.
+func saveToFile(localFile string, content io.Reader) error {
+	file, err := createLocalFile(localFile)
 	if err != nil {
-		debugLog("Failed to create file %s: %v", localFile, err)
-		return
+		return err
 	}
 	defer file.Close()
 
 	_, err = io.Copy(file, content)
 	if err != nil {
-		debugLog("Failed to save content for key %s: %v", key, err)
+		debugLog("Failed to save content to %s: %v", localFile, err)
+		return err
+	}
+	return nil
+}
+
+// createLocalFile creates a download's local file and its directories. With
+// -no-overwrite or -skip-existing an existing file is left alone and an error
+// wrapping fs.ErrExist is returned.
+func createLocalFile(localFile string) (*os.File, error) {
+	if err := guardLocalPath(localFile); err != nil {
+		return nil, err
+	}
+	if dir := filepath.Dir(localFile); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			debugLog("Failed to create directory %s: %v", dir, err)
+			return nil, err
+		}
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if *noOverwrite || *skipExisting {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	}
+	file, err := os.OpenFile(localFile, flags, 0o666)
+	if errors.Is(err, fs.ErrExist) {
+		debugLog("Not overwriting existing file %s", localFile)
+		skippedExisting.Add(1)
+		return nil, err
+	}
+	if err != nil {
+		debugLog("Failed to create file %s: %v", localFile, err)
+		return nil, err
 	}
+	return file, nil
 }
 
-// readURLsFromFile reads URLs from a file, one per line
-func readURLsFromFile(filename string) []string {
+// readLines reads a file of URLs or prefixes, one per line
+func readLines(filename string) []string {
 	var urls []string
 	file, err := os.Open(filename)
 	if err != nil {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keyExtension returns the lower-cased extension of a key, or "(none)"
+func keyExtension(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if ext == "" {
+		return "(none)"
+	}
+	return ext
+}
+
+// sampleByExtension keeps the first limit objects of every extension, in
+// listing order. The counts hold the number of selected and listed objects
+// per extension.
+func sampleByExtension(objects []s3Object, limit int) ([]s3Object, map[string][2]int) {
+	counts := make(map[string][2]int)
+	var selected []s3Object
+	for _, object := range objects {
+		ext := keyExtension(object.Key)
+		count := counts[ext]
+		if count[0] < limit {
+			selected = append(selected, object)
+			count[0]++
+		}
+		count[1]++
+		counts[ext] = count
+	}
+	return selected, counts
+}
+
+// printExtensionSummary prints how many keys of each extension were selected
+// by -limit-per-extension out of how many were listed
+func printExtensionSummary(w io.Writer, counts map[string][2]int) {
+	if len(counts) == 0 {
+		return
+	}
+	extensions := make([]string, 0, len(counts))
+	for ext := range counts {
+		extensions = append(extensions, ext)
+	}
+	sort.Slice(extensions, func(i, j int) bool {
+		if counts[extensions[i]][1] != counts[extensions[j]][1] {
+			return counts[extensions[i]][1] > counts[extensions[j]][1]
+		}
+		return extensions[i] < extensions[j]
+	})
+	fmt.Fprintln(w, "Keys per extension (selected of listed):")
+	for _, ext := range extensions {
+		fmt.Fprintf(w, "%8d of %-8d %s\n", counts[ext][0], counts[ext][1], ext)
+	}
+}
+
+// sampleObjects picks n objects at random with reservoir sampling, which
+// takes a single pass, and returns them in listing order. The seed of the
+// random source is -seed, or a new one that is logged so that the sample can
+// be repeated.
+func sampleObjects(objects []s3Object, n int) []s3Object {
+	if len(objects) <= n {
+		return objects
+	}
+	seed := *sampleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(seed))
+	picked := make([]int, 0, n)
+	for i := range objects {
+		if i < n {
+			picked = append(picked, i)
+		} else if j := random.Intn(i + 1); j < n {
+			picked[j] = i
+		}
+	}
+	sort.Ints(picked)
+
+	sample := make([]s3Object, len(picked))
+	for i, index := range picked {
+		sample[i] = objects[index]
+	}
+	log.Printf("Sampled %d of %d keys (-seed %d)", n, len(objects), seed)
+	return sample
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// secretMaxFindings is the number of -secrets findings kept per key
+const secretMaxFindings = 100
+
+// redactModes are the values of -secrets-redact
+var redactModes = []string{"partial", "full", "none"}
+
+// secretRule is a credential pattern of -secrets. When the pattern has a
+// group named secret, only that part of the match is redacted, so the
+// surrounding context stays readable; without it the match is not secret by
+// itself, like the header of a private key. A rule with a minimum entropy
+// skips secrets below it, such as placeholders and example values.
+type secretRule struct {
+	name       string
+	pattern    *regexp.Regexp
+	minEntropy float64 // bits per character of the secret, 0 to accept any
+}
+
+// secretRules are the rules -secrets applies to every line, in order; a match
+// overlapping one of an earlier rule on the same line is not reported again,
+// so specific rules come before generic ones. Add an entry here to detect
+// another kind of credential.
+var secretRules = []secretRule{
+	{name: "aws-access-key-id", pattern: regexp.MustCompile(`\b(?P<secret>(?:AKIA|ASIA|ABIA|ACCA|A3T[A-Z0-9])[A-Z2-7]{16})\b`)},
+	{name: "aws-secret-access-key", pattern: regexp.MustCompile(`(?i)aws.{0,20}(?:secret|private).{0,20}?["']?\s*[:=]\s*["']?(?P<secret>[A-Za-z0-9/+]{40})`), minEntropy: 3.5},
+	{name: "private-key", pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`)},
+	{name: "github-token", pattern: regexp.MustCompile(`\b(?P<secret>gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	{name: "gitlab-token", pattern: regexp.MustCompile(`\b(?P<secret>glpat-[A-Za-z0-9_-]{20})`)},
+	{name: "slack-token", pattern: regexp.MustCompile(`\b(?P<secret>xox[baprs]-[A-Za-z0-9-]{10,})`)},
+	{name: "slack-webhook", pattern: regexp.MustCompile(`https://hooks\.slack\.com/services/(?P<secret>T[A-Za-z0-9_]+/B[A-Za-z0-9_]+/[A-Za-z0-9_]+)`)},
+	{name: "google-api-key", pattern: regexp.MustCompile(`\b(?P<secret>AIza[0-9A-Za-z_-]{35})`)},
+	{name: "stripe-key", pattern: regexp.MustCompile(`\b(?P<secret>(?:sk|rk)_live_[0-9A-Za-z]{24,})`)},
+	{name: "jwt", pattern: regexp.MustCompile(`\b(?P<secret>eyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,})`)},
+	{name: "url-credentials", pattern: regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s:/@]+:(?P<secret>[^\s:/@]{3,})@`)},
+	{name: "generic-secret", pattern: regexp.MustCompile("(?i)\\b(?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key|client[_-]?secret)[\"']?\\s*[:=]\\s*[\"']?(?P<secret>[^\\s\"'`,;]{8,})"), minEntropy: 3},
+}
+
+// secretFinding is a credential found by -secrets
+type secretFinding struct {
+	Rule  string `json:"rule"`
+	Line  int    `json:"line"`
+	Match string `json:"match,omitempty"` // redacted according to -secrets-redact, absent with full
+}
+
+// secretResult holds the -secrets findings of one object
+type secretResult struct {
+	Findings []secretFinding `json:"findings"`
+	Count    int             `json:"count"` // findings, including those beyond the ones kept
+}
+
+// secretResults records the findings of every scanned key by URL, for the
+// output and the JSON report
+var secretResults struct {
+	sync.Mutex
+	byURL map[string]*secretResult
+}
+
+// matchLine applies every rule to a line of an object body
+func (r *secretResult) matchLine(line []byte, lineNo int) {
+	var spans [][2]int
+	for _, rule := range secretRules {
+		group := rule.pattern.SubexpIndex("secret")
+		for _, m := range rule.pattern.FindAllSubmatchIndex(line, -1) {
+			overlaps := false
+			for _, span := range spans {
+				overlaps = overlaps || (m[0] < span[1] && span[0] < m[1])
+			}
+			if overlaps {
+				continue
+			}
+			start, end := m[0], m[1]
+			if group > 0 && m[2*group] >= 0 {
+				start, end = m[2*group], m[2*group+1]
+			}
+			if rule.minEntropy > 0 && entropy(line[start:end]) < rule.minEntropy {
+				continue
+			}
+			spans = append(spans, [2]int{m[0], m[1]})
+			r.Count++
+			if len(r.Findings) >= secretMaxFindings {
+				continue
+			}
+			finding := secretFinding{Rule: rule.name, Line: lineNo}
+			if *secretsRedact != "full" {
+				match := string(line[m[0]:start]) + redactSecret(string(line[start:end]), group > 0) + string(line[end:m[1]])
+				finding.Match = strings.ToValidUTF8(match, "?")
+			}
+			r.Findings = append(r.Findings, finding)
+		}
+	}
+}
+
+// record keeps the findings of an object, if there are any
+func (r *secretResult) record(object s3Object) {
+	if r.Count == 0 {
+		return
+	}
+	secretResults.Lock()
+	defer secretResults.Unlock()
+	if secretResults.byURL == nil {
+		secretResults.byURL = make(map[string]*secretResult)
+	}
+	secretResults.byURL[object.url()] = r
+}
+
+// objectSecrets returns the -secrets findings of an object, or nil if it was
+// not scanned or nothing was found
+func objectSecrets(object s3Object) *secretResult {
+	secretResults.Lock()
+	defer secretResults.Unlock()
+	return secretResults.byURL[object.url()]
+}
+
+// redactSecret returns a secret as -secrets-redact partial shows it: its
+// first and last 4 characters, or only stars when it is too short for that.
+// Matches that are not secret themselves are returned unchanged.
+func redactSecret(secret string, isSecret bool) string {
+	if !isSecret || *secretsRedact == "none" {
+		return secret
+	}
+	if len(secret) <= 12 {
+		return "****"
+	}
+	return secret[:4] + "****" + secret[len(secret)-4:]
+}
+
+// entropy returns the Shannon entropy of b in bits per byte
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	bits := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
+
+// printSecretFindings writes the findings of the objects, in their order, as
+// key:line: rule: match, and logs how many were found
+func printSecretFindings(w io.Writer, objects []s3Object) {
+	total, keys := 0, 0
+	for _, object := range objects {
+		result := objectSecrets(object)
+		if result == nil {
+			continue
+		}
+		total += result.Count
+		keys++
+		key := object.displayKey()
+		for _, finding := range result.Findings {
+			if finding.Match == "" {
+				fmt.Fprintf(w, "%s:%d: %s\n", key, finding.Line, finding.Rule)
+			} else {
+				fmt.Fprintf(w, "%s:%d: %s: %s\n", key, finding.Line, finding.Rule, finding.Match)
+			}
+		}
+		if more := result.Count - len(result.Findings); more > 0 {
+			fmt.Fprintf(w, "%s: %d more findings not shown\n", key, more)
+		}
+	}
+	log.Printf("-secrets found %d possible secrets in %d keys", total, keys)
+}
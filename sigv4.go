@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	defaultRegion   = "us-east-1"
+)
+
+// awsCredentials holds the key pair (and optional session token) used for SigV4 signing
+type awsCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string // region configured for the profile, if any
+}
+
+// resolveCredentials returns the credentials selected by the command-line flags.
+// Explicit keys take precedence over -profile. ok is false when the requests
+// should be sent anonymously.
+func resolveCredentials() (creds awsCredentials, ok bool) {
+	creds, ok = resolveKeys()
+	if !ok {
+		return creds, false
+	}
+	// Temporary (STS) credentials: -session-token, then AWS_SESSION_TOKEN for
+	// keys given as flags, or the profile's own token. A token only works with
+	// the keys it was issued with, so the environment never replaces the
+	// token of a profile.
+	if *sessionToken != "" {
+		creds.SessionToken = *sessionToken
+	} else if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" && *accessKey != "" {
+		creds.SessionToken = token
+	}
+	return creds, true
+}
+
+// resolveKeys returns the access key pair from the explicit flags or the -profile
+func resolveKeys() (creds awsCredentials, ok bool) {
+	if *accessKey != "" || *secretKey != "" {
+		if *accessKey == "" || *secretKey == "" {
+			log.Fatal("Both -access-key and -secret-key must be specified")
+		}
+		return awsCredentials{AccessKey: *accessKey, SecretKey: *secretKey}, true
+	}
+	if *profile == "" {
+		return awsCredentials{}, false
+	}
+
+	creds, err := loadProfile(*profile)
+	if err != nil {
+		debugLog("Failed to load AWS profile %s: %v. Falling back to anonymous requests.", *profile, err)
+		return awsCredentials{}, false
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		debugLog("AWS profile %s has no access key. Falling back to anonymous requests.", *profile)
+		return awsCredentials{}, false
+	}
+	return creds, true
+}
+
+// loadProfile reads the named profile from the AWS shared credentials and config files.
+// Values from the credentials file take precedence over the config file.
+func loadProfile(name string) (awsCredentials, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+
+	values := make(map[string]string)
+	configSection := "profile " + name
+	if name == "default" {
+		configSection = "default"
+	}
+	found := false
+	for _, source := range []struct{ file, section string }{
+		{configFile, configSection},
+		{credentialsFile, name},
+	} {
+		section, err := readINISection(source.file, source.section)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return awsCredentials{}, err
+		}
+		if section != nil {
+			found = true
+		}
+		for k, v := range section {
+			values[k] = v
+		}
+	}
+	if !found {
+		return awsCredentials{}, fmt.Errorf("profile not found in %s or %s", credentialsFile, configFile)
+	}
+
+	return awsCredentials{
+		AccessKey:    values["aws_access_key_id"],
+		SecretKey:    values["aws_secret_access_key"],
+		SessionToken: values["aws_session_token"],
+		Region:       values["region"],
+	}, nil
+}
+
+// readINISection returns the key/value pairs of a section in an ini file, or nil if it is absent
+func readINISection(filename, name string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var values map[string]string
+	inSection := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == name
+			if inSection && values == nil {
+				values = make(map[string]string)
+			}
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// regionPattern extracts the region from AWS S3 endpoint hostnames such as
+// bucket.s3.us-west-2.amazonaws.com or s3-eu-west-1.amazonaws.com
+var regionPattern = regexp.MustCompile(`(?:^|\.)s3[.-](?:dualstack\.)?([a-z]{2}(?:-gov)?-[a-z]+-\d)\.amazonaws\.com$`)
+
+// signingRegion picks the region for a host: -region, then the endpoint name, then the profile
+func signingRegion(host string, creds awsCredentials) string {
+	if *region != "" {
+		return *region
+	}
+	if m := regionPattern.FindStringSubmatch(strings.ToLower(host)); m != nil {
+		return m[1]
+	}
+	if creds.Region != "" {
+		return creds.Region
+	}
+	return defaultRegion
+}
+
+// signingTransport signs every request with AWS Signature Version 4
+type signingTransport struct {
+	next  http.RoundTripper
+	creds awsCredentials
+}
+
+// isPresigned reports whether a URL carries query string authentication:
+// X-Amz-Signature for SigV4, Signature for SigV2
+func isPresigned(u *url.URL) bool {
+	query := u.Query()
+	return query.Get("X-Amz-Signature") != "" || query.Get("Signature") != ""
+}
+
+// RoundTrip signs a copy of the request and passes it on
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A presigned URL is already authorized by its query
+	if isPresigned(req.URL) {
+		return t.next.RoundTrip(req)
+	}
+	signed := req.Clone(req.Context())
+	signRequest(signed, t.creds, signingRegion(req.URL.Hostname(), t.creds), time.Now().UTC())
+	return t.next.RoundTrip(signed)
+}
+
+// signRequest adds the SigV4 Authorization header to the request for the s3 service.
+// Payloads are not hashed unless the caller already set X-Amz-Content-Sha256;
+// S3 accepts UNSIGNED-PAYLOAD over any transport.
+func signRequest(req *http.Request, creds awsCredentials, region string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "x-amz-date" || lower == "x-amz-content-sha256" || lower == "x-amz-security-token" ||
+			lower == "range" || lower == "content-md5" || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query parameters sorted by name as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything except unreserved characters.
+// Slashes are kept unless encodeSlash is set (query components).
+func awsURIEncode(s string, encodeSlash bool) string {
+	if s == "" && !encodeSlash {
+		return "/"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
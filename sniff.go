@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// sniffLen is the number of leading bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// genericContentTypes are Content-Type values that say nothing about the
+// content, so the sniffed type is used instead
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/x-download":   true,
+	"application/download":     true,
+	"application/unknown":      true,
+}
+
+// downloadedTypes records the content type of every downloaded key by URL,
+// for the summary after -D and the JSON report
+var downloadedTypes struct {
+	sync.Mutex
+	byURL map[string]string
+}
+
+// sniffReader keeps a copy of the first sniffLen bytes read through it
+type sniffReader struct {
+	r    io.Reader
+	head []byte
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if missing := sniffLen - len(s.head); missing > 0 {
+		s.head = append(s.head, p[:min(n, missing)]...)
+	}
+	return n, err
+}
+
+// detectContentType returns the media type of a download: the Content-Type
+// sent by the server, unless it is generic, then the type sniffed from head
+func detectContentType(header string, head []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(header)
+	if genericContentTypes[mediaType] {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	return mediaType
+}
+
+// recordContentType remembers the content type of a downloaded object
+func recordContentType(object s3Object, header string, head []byte) {
+	downloadedTypes.Lock()
+	defer downloadedTypes.Unlock()
+	if downloadedTypes.byURL == nil {
+		downloadedTypes.byURL = make(map[string]string)
+	}
+	downloadedTypes.byURL[object.url()] = detectContentType(header, head)
+}
+
+// downloadedType returns the recorded content type of an object, if it was downloaded
+func downloadedType(object s3Object) string {
+	downloadedTypes.Lock()
+	defer downloadedTypes.Unlock()
+	return downloadedTypes.byURL[object.url()]
+}
+
+// printContentTypeSummary prints how many downloaded keys there are of each
+// content type, most common first
+func printContentTypeSummary(w io.Writer) {
+	downloadedTypes.Lock()
+	counts := make(map[string]int)
+	for _, contentType := range downloadedTypes.byURL {
+		counts[contentType]++
+	}
+	downloadedTypes.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	types := make([]string, 0, len(counts))
+	for contentType := range counts {
+		types = append(types, contentType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if counts[types[i]] != counts[types[j]] {
+			return counts[types[i]] > counts[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	fmt.Fprintln(w, "Content types:")
+	for _, contentType := range types {
+		fmt.Fprintf(w, "%8d  %s\n", counts[contentType], contentType)
+	}
+}
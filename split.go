@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// splitDownload downloads a large object as -split-parts concurrent byte
+// ranges. It only applies to objects listed with at least -split-threshold
+// bytes, so small files cost no extra request. A HEAD must then confirm the
+// size and that the server advertises Accept-Ranges: bytes, and the first range
+// must come back as 206 Partial Content. Otherwise handled is false and the
+// object should be downloaded with a single GET. All parts share one
+// -stall-timeout watch, so stalled is true once none of them has received
+// anything for that long; the file is then removed and its bytes are taken
+// back from the progress, and the failure is left to the caller.
+func splitDownload(object s3Object, localFile string, progress func(int64)) (handled, ok, stalled bool) {
+	if object.Size < *splitThreshold {
+		return false, false, false
+	}
+	url := object.url()
+	head, err := headObject(url)
+	if err != nil || head.StatusCode != http.StatusOK || head.ContentLength < *splitThreshold ||
+		!strings.Contains(head.Header.Get("Accept-Ranges"), "bytes") {
+		return false, false, false
+	}
+	size := head.ContentLength
+	parts := int64(*splitParts)
+	partSize := (size + parts - 1) / parts
+
+	ctx, cancel, watch := newStallWatch(context.Background(), *stallTimeout)
+	defer cancel()
+	first, err := getRange(ctx, url, 0, min(partSize, size)-1)
+	if err != nil {
+		debugLog("Not splitting %s: %v", url, err)
+		return false, false, false
+	}
+	defer first.Body.Close()
+
+	file, err := createLocalFile(localFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrExist) {
+			recordFailedDownload(object)
+		}
+		return true, false, false
+	}
+	debugLog("Downloading %s in %d parts of %d bytes", url, parts, partSize)
+
+	// The parts report progress concurrently
+	var mu sync.Mutex
+	var written int64
+	report := func(n int64) {
+		mu.Lock()
+		written += n
+		if progress != nil {
+			progress(n)
+		}
+		mu.Unlock()
+	}
+
+	sniffer := &sniffReader{r: watch.reader(first.Body)}
+	errs := make(chan error, parts)
+	var wg sync.WaitGroup
+	for start := int64(0); start < size; start += partSize {
+		end := min(start+partSize, size) - 1
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			var body io.Reader = sniffer
+			if start > 0 {
+				resp, err := getRange(ctx, url, start, end)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer resp.Body.Close()
+				body = watch.reader(resp.Body)
+			}
+			n, err := io.Copy(io.NewOffsetWriter(file, start), &progressReader{r: io.LimitReader(body, end-start+1), progress: report})
+			if err == nil && n != end-start+1 {
+				err = fmt.Errorf("bytes %d-%d: short read of %d bytes", start, end, n)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+
+	err = <-errs
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && watch.fired() {
+		debugLog("Download of %s in parts stalled after %d bytes", url, written)
+		os.Remove(localFile)
+		if progress != nil {
+			progress(-written)
+		}
+		return true, false, true
+	}
+	if err != nil {
+		debugLog("Failed to download %s in parts: %v", url, err)
+		os.Remove(localFile)
+		recordFailedDownload(object)
+		return true, false, false
+	}
+	recordContentType(object, head.ContentType, sniffer.head)
+	recordEncryption(object, head.Header)
+	if *metaFlag {
+		// The cached HEAD has the headers of the whole object, unlike the range responses
+		writeMetadata(object, localFile, head.Header)
+	}
+	state.markKey(object)
+	recordDownload(size)
+	return true, true, false
+}
+
+// getRange requests bytes start-end of a URL with ctx and checks that the
+// server answered with exactly that range
+func getRange(ctx context.Context, url string, start, end int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("bytes %d-%d: got status %d, Content-Range %q", start, end, resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	return resp, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sseSampleKeys is the number of listed keys the -audit sse check sends a HEAD for
+const sseSampleKeys = 10
+
+// sseNone is the encryption status of objects served without SSE headers
+const sseNone = "none"
+
+// downloadedEncryption remembers the encryption status of downloaded objects by URL
+var downloadedEncryption sync.Map
+
+// encryptionStatus returns the server-side encryption of an object from its
+// response headers: the x-amz-server-side-encryption algorithm (AES256,
+// aws:kms, aws:kms:dsse) with the KMS key if any, SSE-C for customer-provided
+// keys, or "none" when the server sent no encryption header
+func encryptionStatus(header http.Header) string {
+	if algorithm := header.Get("x-amz-server-side-encryption-customer-algorithm"); algorithm != "" {
+		return "SSE-C " + algorithm
+	}
+	algorithm := header.Get("x-amz-server-side-encryption")
+	if algorithm == "" {
+		return sseNone
+	}
+	if keyID := header.Get("x-amz-server-side-encryption-aws-kms-key-id"); keyID != "" {
+		return algorithm + " " + keyID
+	}
+	return algorithm
+}
+
+// recordEncryption remembers the encryption status of a downloaded object
+func recordEncryption(object s3Object, header http.Header) {
+	downloadedEncryption.Store(object.url(), encryptionStatus(header))
+}
+
+// objectEncryption returns the encryption status of an object if a download
+// or a HEAD earlier in the run saw its headers
+func objectEncryption(object s3Object) (string, bool) {
+	if status, ok := downloadedEncryption.Load(object.url()); ok {
+		return status.(string), true
+	}
+	if head, ok := cachedHead(object.url()); ok && head.StatusCode == http.StatusOK {
+		return encryptionStatus(head.Header), true
+	}
+	return "", false
+}
+
+// checkListedEncryption sends a HEAD for the first sseSampleKeys listed keys
+// and summarizes their encryption status. Keys served without SSE headers
+// make it a low finding.
+func checkListedEncryption(objects []s3Object) (severity, summary string) {
+	statuses := make(map[string]int)
+	sampled, failed, failure := 0, 0, ""
+	for _, object := range objects[:min(len(objects), sseSampleKeys)] {
+		head, err := headObject(object.url())
+		switch {
+		case err != nil:
+			failed++
+			failure = err.Error()
+		case head.StatusCode != http.StatusOK:
+			failed++
+			failure = fmt.Sprintf("status %d", head.StatusCode)
+		default:
+			sampled++
+			status, _, _ := strings.Cut(encryptionStatus(head.Header), " ")
+			statuses[status]++
+		}
+	}
+	if sampled == 0 {
+		if failed == 0 {
+			return severityInfo, "no keys to sample"
+		}
+		return severityInfo, "could not HEAD the sampled keys (" + failure + ")"
+	}
+
+	var algorithms []string
+	for status, n := range statuses {
+		if status != sseNone {
+			algorithms = append(algorithms, fmt.Sprintf("%s: %d", status, n))
+		}
+	}
+	sort.Strings(algorithms)
+	if n := statuses[sseNone]; n > 0 {
+		summary = fmt.Sprintf("%d of %d sampled keys unencrypted", n, sampled)
+		if len(algorithms) > 0 {
+			summary += " (" + strings.Join(algorithms, ", ") + ")"
+		}
+		return severityLow, summary
+	}
+	return severityInfo, fmt.Sprintf("%d sampled keys encrypted (%s)", sampled, strings.Join(algorithms, ", "))
+}
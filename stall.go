@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stallWatch cancels a download that receives no bytes for -stall-timeout,
+// which a half-open connection would otherwise keep waiting forever (or until
+// -timeout). The timer runs from before the request is sent and restarts on
+// every read of the body. A nil stallWatch never fires.
+type stallWatch struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// newStallWatch starts watching a download whose request uses ctx, or returns
+// ctx unchanged and a nil watch when -stall-timeout is not set. The returned
+// cancel function must be called once the download is done.
+func newStallWatch(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, *stallWatch) {
+	ctx, cancel := context.WithCancel(ctx)
+	if timeout <= 0 {
+		return ctx, cancel, nil
+	}
+	w := &stallWatch{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.stalled.Store(true)
+		cancel()
+	})
+	return ctx, func() {
+		w.timer.Stop()
+		cancel()
+	}, w
+}
+
+// fired reports whether the download was canceled for stalling
+func (w *stallWatch) fired() bool {
+	return w != nil && w.stalled.Load()
+}
+
+// reader returns r with the stall timer restarted on every read that returns data
+func (w *stallWatch) reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: func(int64) { w.timer.Reset(w.timeout) }}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallingWriter passes the first left bytes of a response on, then stops
+// sending until the request is canceled, like a half-open connection
+type stallingWriter struct {
+	http.ResponseWriter
+	left int
+	r    *http.Request
+}
+
+func (w *stallingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p[:min(len(p), w.left)])
+	w.left -= n
+	if err != nil || n == len(p) {
+		return n, err
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+	<-w.r.Context().Done()
+	return n, errors.New("stalled")
+}
+
+// newStallingServer serves content, stalling the first GET after 100 bytes.
+// It returns the Range headers of every GET.
+func newStallingServer(t *testing.T, content []byte) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			first := len(ranges) == 1
+			mu.Unlock()
+			if first {
+				w = &stallingWriter{ResponseWriter: w, left: 100, r: r}
+			}
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "object.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+func TestStallTimeout(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	tests := []struct {
+		name   string
+		flags  map[string]string
+		ranges []string // of every GET, the first one stalls
+	}{
+		{name: "single GET", flags: map[string]string{"split-threshold": "0"}, ranges: []string{"", ""}},
+		{name: "resume", flags: map[string]string{"resume": "true"}, ranges: []string{"", "bytes=100-"}},
+		{name: "split", flags: map[string]string{"split-threshold": "500", "split-parts": "2"},
+			ranges: []string{"bytes=0-499", "bytes=500-999", "bytes=0-499", "bytes=500-999"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, ranges := newStallingServer(t, content)
+			t.Chdir(t.TempDir())
+			test.flags["stall-timeout"] = "200ms"
+			test.flags["retries"] = "1"
+			setFlags(t, test.flags)
+
+			object := s3Object{Bucket: server.URL + "/bucket", Key: "object.bin", Size: int64(len(content))}
+			var progress int64
+			if !downloadAndSave(object, func(n int64) { progress += n }) {
+				t.Fatal("download failed")
+			}
+			data, err := os.ReadFile("object.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("saved %d bytes, want %d", len(data), len(content))
+			}
+			if progress != int64(len(content)) {
+				t.Errorf("progress reached %d, want %d", progress, len(content))
+			}
+			if _, err := os.Stat("object.bin" + partSuffix); err == nil {
+				t.Error(".part file left behind")
+			}
+			if got := ranges(); !slices.Equal(got, test.ranges) {
+				t.Errorf("got GETs with ranges %q, want %q", got, test.ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// stateSaveEvery is the number of completed downloads after which -state is written
+const stateSaveEvery = 50
+
+// jobState is the progress of a -state job: the buckets whose work is done,
+// which of them a run with -D completed, the keys that were downloaded, the
+// ETags of the listings of completed buckets and where unfinished listings
+// stopped. It is shared by the download workers.
+type jobState struct {
+	mu        sync.Mutex
+	path      string
+	buckets   map[string]bool
+	downloads map[string]bool // completed buckets whose listed keys were all downloaded
+	keys      map[string]bool
+	etags     map[string]map[string]string          // bucket URL -> first page URL -> ETag
+	positions map[string]map[string]listingPosition // bucket URL -> prefix -> where listing stopped
+	unsaved   int
+	skipped   atomic.Int64 // keys not downloaded again because the state lists them
+	disabled  bool
+}
+
+// stateFile is the JSON document written to -state
+type stateFile struct {
+	Version           int                                   `json:"version"`
+	CompletedBuckets  []string                              `json:"completed_buckets"`
+	DownloadedBuckets []string                              `json:"downloaded_buckets,omitempty"`
+	DownloadedKeys    []string                              `json:"downloaded_keys"`
+	ListingETags      map[string]map[string]string          `json:"listing_etags,omitempty"`
+	ListingPositions  map[string]map[string]listingPosition `json:"listing_positions,omitempty"`
+}
+
+// listingPosition is the page token an unfinished listing stopped at, with the
+// listing parameters it is only valid for
+type listingPosition struct {
+	Param       string `json:"param"` // marker, start-after or continuation-token
+	Value       string `json:"value"`
+	ListVersion int    `json:"list_version"`
+	StartAfter  string `json:"start_after,omitempty"` // -start-after of the run that started the listing
+	Downloaded  bool   `json:"downloaded,omitempty"`  // the keys listed before it were all downloaded
+}
+
+// state is the loaded -state, or nil without -state
+var state *jobState
+
+// loadState reads a state file. A missing file starts an empty job.
+func loadState(path string) (*jobState, error) {
+	s := &jobState{path: path, buckets: make(map[string]bool), downloads: make(map[string]bool), keys: make(map[string]bool), etags: make(map[string]map[string]string),
+		positions: make(map[string]map[string]listingPosition)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file stateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	for _, bucket := range file.CompletedBuckets {
+		s.buckets[bucket] = true
+	}
+	for _, bucket := range file.DownloadedBuckets {
+		s.downloads[bucket] = true
+	}
+	for _, key := range file.DownloadedKeys {
+		s.keys[key] = true
+	}
+	for bucket, etags := range file.ListingETags {
+		s.etags[bucket] = etags
+	}
+	for bucket, positions := range file.ListingPositions {
+		s.positions[bucket] = positions
+	}
+	log.Printf("Resuming from %s: %d buckets completed, %d partially listed, %d keys downloaded", path, len(s.buckets), len(s.positions), len(s.keys))
+	return s, nil
+}
+
+// bucketDone reports whether a bucket was completed by an earlier run and can
+// be skipped. Completed buckets whose listing had an ETag are listed again,
+// conditionally, so that changes are picked up.
+func (s *jobState) bucketDone(bucketURL string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completedLocked(bucketURL) && len(s.etags[bucketURL]) == 0
+}
+
+// completedLocked reports whether an earlier run completed a bucket. With
+// -D, a bucket completed by a run that only listed it is not done yet.
+func (s *jobState) completedLocked(bucketURL string) bool {
+	return s.buckets[bucketURL] && (!*downloadAll || s.downloads[bucketURL])
+}
+
+// listingETag returns the ETag of the first page of a completed bucket's
+// listing, to send as If-None-Match, or "" if there is none
+func (s *jobState) listingETag(bucketURL, pageURL string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.completedLocked(bucketURL) {
+		return ""
+	}
+	return s.etags[bucketURL][pageURL]
+}
+
+// listingPosition returns the page token an earlier run stopped listing a
+// bucket prefix at. Positions recorded with another -list-version or
+// -start-after are ignored, as their token means something else there, and
+// so are positions of runs without -D when downloading, as the keys before
+// them were not downloaded.
+func (s *jobState) listingPosition(bucketURL, prefix string) (pageToken, bool) {
+	if s == nil {
+		return pageToken{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	position, ok := s.positions[bucketURL][prefix]
+	if !ok {
+		return pageToken{}, false
+	}
+	valid := position.Param == "marker"
+	if position.ListVersion == 2 {
+		valid = position.Param == "continuation-token" || position.Param == "start-after"
+	}
+	if *downloadAll && !position.Downloaded {
+		log.Printf("Listing %s from the start, the run recorded in %s did not download its keys", bucketURL, s.path)
+		return pageToken{}, false
+	}
+	if !valid || position.ListVersion != *listVersion || position.StartAfter != *startAfter {
+		log.Printf("Listing %s from the start, the position recorded in %s is for other listing parameters", bucketURL, s.path)
+		return pageToken{}, false
+	}
+	return pageToken{position.Param, position.Value}, true
+}
+
+// setPositionLocked records where the listing of a bucket prefix stopped, or
+// forgets it for the zero token of a prefix that was listed to the end
+func (s *jobState) setPositionLocked(bucketURL, prefix string, next pageToken, downloaded bool) {
+	if next == (pageToken{}) {
+		delete(s.positions[bucketURL], prefix)
+		if len(s.positions[bucketURL]) == 0 {
+			delete(s.positions, bucketURL)
+		}
+		return
+	}
+	if s.positions[bucketURL] == nil {
+		s.positions[bucketURL] = make(map[string]listingPosition)
+	}
+	s.positions[bucketURL][prefix] = listingPosition{Param: next.param, Value: next.value, ListVersion: *listVersion, StartAfter: *startAfter, Downloaded: downloaded}
+}
+
+// keyDone reports whether an object was downloaded by an earlier run
+func (s *jobState) keyDone(object s3Object) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[object.url()]
+}
+
+// markKey records a finished download, saving the state every stateSaveEvery downloads
+func (s *jobState) markKey(object s3Object) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[object.url()] = true
+	if s.unsaved++; s.unsaved >= stateSaveEvery {
+		s.saveLocked()
+	}
+}
+
+// markBuckets records the buckets whose work is done: listed completely and,
+// when downloading, with every listed key downloaded. Whether every key was
+// downloaded is recorded separately, as a later run with -D cannot skip a
+// bucket that was only listed. Once every listed key is done, where a listing
+// stopped early (at -l or a failed page) is recorded too, so that the next
+// run continues from there.
+func (s *jobState) markBuckets(listings []bucketListing, downloading bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, listing := range listings {
+		downloaded := true
+		for _, object := range listing.Objects {
+			if !s.keys[object.url()] {
+				downloaded = false
+				break
+			}
+		}
+		done := downloaded || !downloading
+		if done {
+			for prefix, next := range listing.Positions {
+				s.setPositionLocked(listing.URL, prefix, next, downloaded)
+				s.unsaved++
+			}
+		}
+		if listing.Status.failed() || listing.Truncated {
+			continue
+		}
+		if done {
+			s.buckets[listing.URL] = true
+			// An unchanged bucket keeps what the run that listed it downloaded
+			if listing.Status != listingUnchanged && downloaded {
+				s.downloads[listing.URL] = true
+			} else if listing.Status != listingUnchanged {
+				delete(s.downloads, listing.URL)
+			}
+			delete(s.positions, listing.URL)
+			// Merge, as unchanged prefixes of the bucket keep their ETags
+			for pageURL, etag := range listing.ETags {
+				if s.etags[listing.URL] == nil {
+					s.etags[listing.URL] = make(map[string]string)
+				}
+				s.etags[listing.URL][pageURL] = etag
+			}
+			s.unsaved++
+		}
+	}
+}
+
+// save writes the state file
+func (s *jobState) save() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saveLocked()
+}
+
+// saveLocked writes the state file through a temporary file, so an
+// interrupted write never leaves a truncated state behind
+func (s *jobState) saveLocked() {
+	if s.disabled {
+		return
+	}
+	file := stateFile{Version: 1, CompletedBuckets: sortedKeys(s.buckets), DownloadedBuckets: sortedKeys(s.downloads), DownloadedKeys: sortedKeys(s.keys), ListingETags: s.etags, ListingPositions: s.positions}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode state: %v", err)
+		return
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err == nil {
+		_, err = temp.Write(append(data, '\n'))
+		if closeErr := temp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(temp.Name(), s.path)
+		}
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save state to %s: %v", s.path, err)
+		return
+	}
+	s.unsaved = 0
+}
+
+// saveOnSignal saves the state and exits when the process is interrupted
+func (s *jobState) saveOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		s.mu.Lock()
+		s.saveLocked()
+		s.disabled = true // no more writes while exiting
+		s.mu.Unlock()
+		log.Printf("Interrupted by %v, saved state to %s", sig, s.path)
+		os.Exit(130)
+	}()
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
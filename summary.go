@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// runTotals accumulates the figures reported by -summary-json
+var runTotals struct {
+	start           time.Time
+	keysFound       int
+	bucketsListed   int
+	bucketsFailed   int
+	downloaded      atomic.Int64
+	downloadedBytes atomic.Int64
+}
+
+// runSummary is the line written by -summary-json
+type runSummary struct {
+	KeysFound       int     `json:"keys_found"`
+	KeysDownloaded  int64   `json:"keys_downloaded"`
+	BytesDownloaded int64   `json:"bytes_downloaded"`
+	DownloadErrors  int     `json:"download_errors"`
+	BucketsListed   int     `json:"buckets_listed"`
+	BucketsFailed   int     `json:"buckets_failed"`
+	ElapsedSeconds  float64 `json:"elapsed_seconds"`
+	ExitCode        int     `json:"exit_code"`
+}
+
+// recordDownload counts a saved download of size bytes
+func recordDownload(size int64) {
+	runTotals.downloaded.Add(1)
+	runTotals.downloadedBytes.Add(size)
+}
+
+// recordListings counts the listed buckets and the keys that matched
+func recordListings(listings []bucketListing, matched []s3Object) {
+	runTotals.keysFound = len(matched)
+	runTotals.bucketsListed = len(listings)
+	for _, listing := range listings {
+		if listing.Status.failed() {
+			runTotals.bucketsFailed++
+		}
+	}
+}
+
+// writeRunSummary writes the -summary-json line
+func writeRunSummary(w io.Writer, exitCode int) {
+	data, err := json.Marshal(runSummary{
+		KeysFound:       runTotals.keysFound,
+		KeysDownloaded:  runTotals.downloaded.Load(),
+		BytesDownloaded: runTotals.downloadedBytes.Load(),
+		DownloadErrors:  failedDownloadCount(),
+		BucketsListed:   runTotals.bucketsListed,
+		BucketsFailed:   runTotals.bucketsFailed,
+		ElapsedSeconds:  time.Since(runTotals.start).Round(time.Millisecond).Seconds(),
+		ExitCode:        exitCode,
+	})
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w, string(data))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errSymlinkInPath is returned for downloads whose local path goes through a symbolic link
+var errSymlinkInPath = errors.New("path goes through a symbolic link")
+
+// checkNoSymlinks returns an error wrapping errSymlinkInPath if a directory
+// of a local path, or the file itself, is an existing symbolic link. Keys
+// become paths below the current directory, so a symlink planted there (or
+// left by an earlier download) would otherwise redirect writes outside of it.
+// Only the part of the path below the current directory is checked, and
+// -follow-symlinks turns the check off.
+func checkNoSymlinks(path string) error {
+	if *followSymlinks {
+		return nil
+	}
+	rel := strings.TrimPrefix(path, `\\?\`)
+	if filepath.IsAbs(rel) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if rel, err = filepath.Rel(wd, rel); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+
+	current := ""
+	for _, segment := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Directories still to be created are created as real directories
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s", errSymlinkInPath, current)
+		}
+	}
+	return nil
+}
+
+// guardLocalPath checks a local path with checkNoSymlinks and logs a refusal
+func guardLocalPath(path string) error {
+	err := checkNoSymlinks(path)
+	if errors.Is(err, errSymlinkInPath) {
+		log.Printf("Refusing to write %s, %v (use -follow-symlinks to allow it)", path, err)
+	}
+	return err
+}
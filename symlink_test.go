@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// symlinkTree creates an output directory reached through a symbolic link,
+// with a real logs directory, a link to a directory outside of it and a link
+// to a file outside of it, and makes the symlinked path the current directory
+func symlinkTree(t *testing.T) {
+	t.Helper()
+	root := t.TempDir()
+	inside, outside := filepath.Join(root, "real"), filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(inside, "logs"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "passwd"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		filepath.Join(root, "out"):        inside,
+		filepath.Join(inside, "escape"):   outside,
+		filepath.Join(inside, "file.txt"): filepath.Join(outside, "passwd"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symbolic links are not supported: %v", err)
+		}
+	}
+	t.Chdir(filepath.Join(root, "out"))
+}
+
+func TestCheckNoSymlinks(t *testing.T) {
+	symlinkTree(t)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		refused bool
+	}{
+		{name: "real directory in a symlinked output directory", path: filepath.Join("logs", "a.txt")},
+		{name: "new directories", path: filepath.Join("logs", "2023", "a.txt")},
+		{name: "absolute path below the output directory", path: filepath.Join(wd, "logs", "a.txt")},
+		{name: "path outside the output directory", path: filepath.Join(filepath.Dir(wd), "outside", "a.txt")},
+		{name: "directory link pointing outside", path: filepath.Join("escape", "a.txt"), refused: true},
+		{name: "absolute path through a directory link", path: filepath.Join(wd, "escape", "a.txt"), refused: true},
+		{name: "file link pointing outside", path: "file.txt", refused: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkNoSymlinks(test.path)
+			if refused := errors.Is(err, errSymlinkInPath); refused != test.refused || (!refused && err != nil) {
+				t.Errorf("checkNoSymlinks(%s) = %v, want refused %v", test.path, err, test.refused)
+			}
+		})
+	}
+}
+
+func TestCheckNoSymlinksFollow(t *testing.T) {
+	symlinkTree(t)
+	defer func(follow bool) { *followSymlinks = follow }(*followSymlinks)
+	*followSymlinks = true
+	for _, path := range []string{filepath.Join("escape", "a.txt"), "file.txt"} {
+		if err := checkNoSymlinks(path); err != nil {
+			t.Errorf("checkNoSymlinks(%s) with -follow-symlinks = %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Tagging is the XML returned by GET ?tagging on a bucket or an object
+type Tagging struct {
+	TagSet []struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	} `xml:"TagSet>Tag"`
+}
+
+// tagResult is what the tags of a bucket or an object show
+type tagResult struct {
+	Readable bool   // the tags could be read, or are known to be absent
+	Error    string // S3 error code when the tags could not be read
+	Tags     [][2]string
+}
+
+// String summarizes the tags, e.g. "classification=secret, owner=hr"
+func (r tagResult) String() string {
+	switch {
+	case !r.Readable:
+		return "unknown (" + r.Error + ")"
+	case len(r.Tags) == 0:
+		return "none"
+	}
+	tags := make([]string, len(r.Tags))
+	for i, tag := range r.Tags {
+		tags[i] = tag[0] + "=" + tag[1]
+	}
+	return strings.Join(tags, ", ")
+}
+
+// tagMap returns the tags as a map, or nil if there are none
+func (r tagResult) tagMap() map[string]string {
+	if len(r.Tags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(r.Tags))
+	for _, tag := range r.Tags {
+		tags[tag[0]] = tag[1]
+	}
+	return tags
+}
+
+// checkTagging reads the tags of a bucket or object URL. Buckets without tags
+// answer NoSuchTagSet.
+func checkTagging(resourceURL string) tagResult {
+	resp, body, err := getSubresource(resourceURL, "tagging")
+	if err != nil {
+		debugLog("Failed to read the tags of %s: %v", resourceURL, err)
+		return tagResult{Error: "request failed"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		code := s3ErrorCode(resp.StatusCode, body)
+		return tagResult{Readable: code == "NoSuchTagSet", Error: code}
+	}
+	var tagging Tagging
+	if err := xml.Unmarshal(body, &tagging); err != nil {
+		debugLog("Error parsing the tags of %s: %v", resourceURL, err)
+		return tagResult{Error: "parse error"}
+	}
+	result := tagResult{Readable: true}
+	for _, tag := range tagging.TagSet {
+		result.Tags = append(result.Tags, [2]string{tag.Key, tag.Value})
+	}
+	return result
+}
+
+// objectTags holds the tags read with -tags by object URL, for the JSON report
+var objectTags struct {
+	sync.Mutex
+	byURL map[string]map[string]string
+}
+
+// readObjectTags reads the tags of every object, at most -t at a time. Unless
+// -json is set, the tagged objects are printed, and the objects whose tags
+// could not be read are counted by error code on stderr.
+func readObjectTags(objects []s3Object) {
+	results := make([]tagResult, len(objects))
+	semaphore := make(chan struct{}, *threads)
+	var wg sync.WaitGroup
+	for i, object := range objects {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, object s3Object) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i] = checkTagging(object.url())
+		}(i, object)
+	}
+	wg.Wait()
+
+	objectTags.Lock()
+	defer objectTags.Unlock()
+	objectTags.byURL = make(map[string]map[string]string)
+	failed := make(map[string]int)
+	var codes []string
+	for i, result := range results {
+		if !result.Readable {
+			if failed[result.Error] == 0 {
+				codes = append(codes, result.Error)
+			}
+			failed[result.Error]++
+			continue
+		}
+		if tags := result.tagMap(); tags != nil {
+			objectTags.byURL[objects[i].url()] = tags
+			if !*jsonOutput {
+				fmt.Printf("Tags of %s: %s\n", objects[i].displayKey(), result)
+			}
+		}
+	}
+	for _, code := range codes {
+		fmt.Fprintf(os.Stderr, "Could not read the tags of %d keys (%s)\n", failed[code], code)
+	}
+}
+
+// taggedObject returns the tags read for an object with -tags, if any
+func taggedObject(object s3Object) map[string]string {
+	objectTags.Lock()
+	defer objectTags.Unlock()
+	return objectTags.byURL[object.url()]
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// throttlePoll is how often a request waiting for the -throttle-on-429 limit checks again
+const throttlePoll = 50 * time.Millisecond
+
+// maxRetryAfter caps the Retry-After wait honored by -throttle-on-429
+const maxRetryAfter = 5 * time.Minute
+
+// throttleTransport implements -throttle-on-429. After a 429 it halves the
+// number of requests allowed in flight, then raises it again by about one per
+// round of successful requests (AIMD) until the limit is lifted. A Retry-After
+// header also holds back new requests until it has passed.
+type throttleTransport struct {
+	next          http.RoundTripper
+	mu            sync.Mutex
+	inFlight      int
+	limit         float64   // requests allowed in flight, 0 while not throttled
+	ceiling       int       // requests in flight when throttling started
+	lastDecrease  time.Time // one burst of 429s halves the limit only once
+	notBefore     time.Time // deadline of the last Retry-After
+	reportedLimit int
+}
+
+// RoundTrip waits until the throttle admits the request, then sends it
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	t.release(req, resp, err)
+	return resp, err
+}
+
+// acquire takes a slot for a request, waiting while the limit is reached or a
+// Retry-After is pending
+func (t *throttleTransport) acquire(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		wait := time.Until(t.notBefore)
+		if wait <= 0 && (t.limit == 0 || float64(t.inFlight) < t.limit) {
+			t.inFlight++
+			t.mu.Unlock()
+			return nil
+		}
+		t.mu.Unlock()
+
+		if wait <= 0 {
+			wait = throttlePoll
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees the slot of a request and adjusts the limit to its outcome
+func (t *throttleTransport) release(req *http.Request, resp *http.Response, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait := min(time.Duration(seconds)*time.Second, maxRetryAfter)
+			if deadline := time.Now().Add(wait); deadline.After(t.notBefore) {
+				t.notBefore = deadline
+				log.Printf("Throttling: %s asked to retry after %s", req.URL.Host, wait)
+			}
+		}
+		if time.Since(t.lastDecrease) < time.Second {
+			return
+		}
+		if t.limit == 0 {
+			t.ceiling = t.inFlight + 1
+			t.limit = float64(t.ceiling)
+		}
+		t.limit = max(1, t.limit/2)
+		t.lastDecrease = time.Now()
+		t.reportedLimit = int(t.limit)
+		log.Printf("Throttling: received 429 from %s, allowing %d concurrent requests", req.URL.Host, int(t.limit))
+		return
+	}
+
+	if err != nil || resp.StatusCode >= 400 || t.limit == 0 {
+		return
+	}
+	t.limit += 1 / t.limit
+	if int(t.limit) >= t.ceiling {
+		t.limit = 0
+		log.Printf("Throttling: no more 429s, lifting the concurrency limit")
+	} else if int(t.limit) != t.reportedLimit {
+		t.reportedLimit = int(t.limit)
+		debugLog("Throttling: allowing %d concurrent requests", t.reportedLimit)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// newTLSConfig returns the TLS settings of every client from the command-line
+// flags, or nil to keep the Go defaults
+func newTLSConfig() (*tls.Config, error) {
+	if *caCert == "" && *clientCert == "" && *clientKey == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if *caCert != "" {
+		roots, err := loadRootCAs(*caCert)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -ca-cert: %v", err)
+		}
+		config.RootCAs = roots
+	}
+	if *clientCert != "" || *clientKey != "" {
+		if *clientCert == "" || *clientKey == "" {
+			return nil, fmt.Errorf("-client-cert and -client-key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the -client-cert and -client-key pair: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadRootCAs returns the system root CAs with the certificates of a PEM file
+// added. The file must hold at least one certificate, so that a wrong path or a
+// key file given by mistake is reported instead of silently trusting nothing new.
+func loadRootCAs(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", filename)
+	}
+	return roots, nil
+}
+
+// configureTLS applies the TLS settings to the base transport and to the
+// DNS-over-HTTPS and -webhook clients
+func configureTLS(transport *http.Transport) {
+	config, err := newTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config == nil {
+		return
+	}
+	transport.TLSClientConfig = config
+	for _, client := range []*http.Client{dohClient, webhookClient} {
+		own := http.DefaultTransport.(*http.Transport).Clone()
+		own.TLSClientConfig = config
+		client.Transport = own
+	}
+}
+
+// parseSNI parses -sni: a single server name for every host, or host=name
+// pairs for some hosts, where host may include the port
+func parseSNI(value string) (all string, byHost map[string]string, err error) {
+	if value == "" {
+		return "", nil, nil
+	}
+	if !strings.Contains(value, "=") {
+		return strings.TrimSpace(value), nil, nil
+	}
+	byHost = make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		host, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || host == "" || name == "" {
+			return "", nil, fmt.Errorf("invalid -sni %q, expected a name or host=name pairs", pair)
+		}
+		byHost[strings.ToLower(host)] = name
+	}
+	return "", byHost, nil
+}
+
+// sniTransport sends requests to the hosts of -sni host=name pairs through a
+// copy of the base transport whose TLS server name is overridden, and all
+// other requests through the base transport
+type sniTransport struct {
+	base   http.RoundTripper
+	byHost map[string]http.RoundTripper // "host:port" or "host" -> transport
+}
+
+func (t *sniTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if next, ok := t.byHost[host]; ok {
+		return next.RoundTrip(req)
+	}
+	if next, ok := t.byHost[strings.ToLower(req.URL.Hostname())]; ok {
+		return next.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// withServerName returns a copy of a transport that sends and verifies name
+// as the TLS server name
+func withServerName(transport *http.Transport, name string) *http.Transport {
+	clone := transport.Clone()
+	if clone.TLSClientConfig == nil {
+		clone.TLSClientConfig = &tls.Config{}
+	}
+	clone.TLSClientConfig.ServerName = name
+	return clone
+}
+
+// applySNI returns the base transport with the -sni overrides applied
+func applySNI(transport *http.Transport) http.RoundTripper {
+	all, byHost, err := parseSNI(*sniFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if all != "" {
+		return withServerName(transport, all)
+	}
+	if len(byHost) == 0 {
+		return transport
+	}
+	sni := &sniTransport{base: transport, byHost: make(map[string]http.RoundTripper, len(byHost))}
+	for host, name := range byHost {
+		sni.byHost[host] = withServerName(transport, name)
+	}
+	return sni
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpClient is the shared client used for every listing and download request
+var httpClient = &http.Client{}
+
+// sensitiveHeaders are redacted from trace output
+var sensitiveHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"Set-Cookie":           true,
+	"X-Amz-Security-Token": true,
+}
+
+// sensitiveParams are query parameters redacted from traced URLs (presigned URL credentials)
+var sensitiveParams = map[string]bool{
+	"x-amz-credential":     true,
+	"x-amz-signature":      true,
+	"x-amz-security-token": true,
+	"signature":            true,
+	"awsaccesskeyid":       true,
+}
+
+// configureHTTPClient builds the transport chain of httpClient from the command-line flags
+func configureHTTPClient() {
+	transport := applySNI(newBaseTransport())
+
+	if *metricsAddr != "" {
+		transport = &metricsTransport{next: transport}
+	}
+
+	if *jitter > 0 {
+		transport = &jitterTransport{next: transport, max: *jitter}
+	}
+
+	if *trace || *traceOut != "" {
+		out := os.Stderr
+		if *traceOut != "" {
+			file, err := os.OpenFile(*traceOut, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				log.Fatalf("Failed to open trace file %s: %v", *traceOut, err)
+			}
+			out = file
+		}
+		transport = &tracingTransport{next: transport, logger: log.New(out, "[trace] ", log.LstdFlags|log.Lmicroseconds)}
+	}
+
+	// Inside the retries, so that every attempt is counted and held back
+	if *throttleOn429 {
+		transport = &throttleTransport{next: transport}
+	}
+
+	if *retries > 0 {
+		retry := &retryTransport{next: transport, retries: *retries}
+		if *retryBudgetFlag > 0 {
+			retry.budget = &retryBudget{}
+			retry.budget.left.Store(int64(*retryBudgetFlag))
+		}
+		transport = retry
+	}
+
+	// Signing wraps the trace so the logged requests carry the (redacted) Authorization header
+	if creds, ok := resolveCredentials(); ok {
+		transport = &signingTransport{next: transport, creds: creds}
+	}
+
+	httpClient.Transport = transport
+	httpClient.Timeout = *requestTimeout
+	httpClient.CheckRedirect = checkRedirect
+}
+
+// errTooManyRedirects is returned by requests that were redirected more than -max-redirects times
+var errTooManyRedirects = errors.New("too many redirects")
+
+// checkRedirect follows up to -max-redirects redirects and then fails the
+// request, which breaks redirect loops
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > *maxRedirects {
+		log.Printf("Not following more than %d redirects for %s (-max-redirects)", *maxRedirects, redactURL(via[0].URL))
+		return fmt.Errorf("%w: stopped after %d (-max-redirects) at %s", errTooManyRedirects, *maxRedirects, redactURL(req.URL))
+	}
+	debugLog("Following redirect from %s to %s", redactURL(via[len(via)-1].URL), redactURL(req.URL))
+	return nil
+}
+
+// newBaseTransport returns the connection-level transport, tuned for -t
+// concurrent requests. The default transport keeps only 2 idle connections per
+// host, so most connections of a concurrent download would be closed and
+// reopened for every key.
+func newBaseTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConns = *maxIdleConns
+	if transport.MaxIdleConns == 0 {
+		transport.MaxIdleConns = max(100, 2**threads)
+	}
+	transport.MaxIdleConnsPerHost = *threads
+	transport.MaxConnsPerHost = *maxConnsPerHost
+	if transport.MaxConnsPerHost > 0 && transport.MaxIdleConnsPerHost > transport.MaxConnsPerHost {
+		transport.MaxIdleConnsPerHost = transport.MaxConnsPerHost
+	}
+	transport.DisableKeepAlives = *disableKeepAlive
+	transport.DialContext = newDialer().DialContext
+	if *dnsResolver != "" {
+		dial, err := resolverDialContext(*dnsResolver)
+		if err != nil {
+			log.Fatalf("Invalid -dns-resolver: %v", err)
+		}
+		transport.DialContext = dial
+	}
+	if *ipv4Only && *ipv6Only {
+		log.Fatal("Only one of -4 and -6 can be specified")
+	}
+	if *ipv4Only || *ipv6Only {
+		transport.DialContext = restrictAddressFamily(transport.DialContext)
+	}
+	configureTLS(transport)
+	return transport
+}
+
+// retryTransport repeats requests that failed with a network error or a
+// -retry-status status, waiting twice as long before every attempt
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	budget  *retryBudget // shared by all requests, nil without -retry-budget
+}
+
+// retryBudget is the number of retries left for the whole run with -retry-budget
+type retryBudget struct {
+	left      atomic.Int64
+	exhausted sync.Once
+}
+
+// take uses up one retry and reports whether one was left
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	if b.left.Add(-1) >= 0 {
+		return true
+	}
+	b.exhausted.Do(func() {
+		log.Printf("Retry budget of %d exhausted (-retry-budget), failed requests are no longer retried", *retryBudgetFlag)
+	})
+	return false
+}
+
+// retryBaseDelay is the wait before the first retry
+const retryBaseDelay = 500 * time.Millisecond
+
+// RoundTrip sends the request up to retries+1 times, as long as the run's
+// -retry-budget lasts. Requests with a body that cannot be replayed are only
+// sent once.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.GetBody == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && hasBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil && !retryStatus.contains(resp.StatusCode) {
+			return resp, nil
+		}
+		if !t.budget.take() {
+			return resp, err
+		}
+		if err == nil {
+			debugLog("Retrying %s %s after status %d (attempt %d of %d)", req.Method, redactURL(req.URL), resp.StatusCode, attempt+1, t.retries)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			debugLog("Retrying %s %s after error: %v (attempt %d of %d)", req.Method, redactURL(req.URL), err, attempt+1, t.retries)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+	}
+}
+
+// jitterTransport waits a random duration between zero and max before every request,
+// breaking up the burst patterns that trigger WAFs and rate limiting
+type jitterTransport struct {
+	next http.RoundTripper
+	max  time.Duration
+}
+
+// RoundTrip sleeps for the jitter delay unless the request is canceled first
+func (t *jitterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := time.Duration(rand.Int63n(int64(t.max) + 1))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return t.next.RoundTrip(req)
+}
+
+// tracingTransport logs every request and response passing through it
+type tracingTransport struct {
+	next   http.RoundTripper
+	logger *log.Logger
+}
+
+// RoundTrip logs the request line and headers, then the response status and timing
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	t.logger.Printf("> %s %s%s", req.Method, redactURL(req.URL), formatHeaders(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		t.logger.Printf("< %s %s error after %s: %v", req.Method, redactURL(req.URL), elapsed, err)
+		return nil, err
+	}
+	t.logger.Printf("< %s %s %s in %s%s", req.Method, redactURL(req.URL), resp.Status, elapsed, formatHeaders(resp.Header))
+	return resp, nil
+}
+
+// redactURL returns the URL as a string with credential query parameters masked
+func redactURL(u *url.URL) string {
+	if u.RawQuery == "" && u.User == nil {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = nil
+	query := redacted.Query()
+	for name := range query {
+		if sensitiveParams[strings.ToLower(name)] {
+			query.Set(name, "REDACTED")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// formatHeaders renders headers on separate indented lines with sensitive values masked
+func formatHeaders(header http.Header) string {
+	var b strings.Builder
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			value = "REDACTED"
+		}
+		fmt.Fprintf(&b, "\n    %s: %s", name, value)
+	}
+	return b.String()
+}
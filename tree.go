@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// treeNode is a single path segment in the key tree
+type treeNode struct {
+	name     string
+	size     int64 // total size of all objects of known size at or below this node
+	unknown  int   // objects of unknown size at or below this node
+	children map[string]*treeNode
+}
+
+// add inserts the path segments below the node, creating missing children
+// and adding size to every node along the way. A size of -1 is unknown and
+// counted apart.
+func (n *treeNode) add(segments []string, size int64) {
+	node := n
+	node.addSize(size)
+	for _, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		if node.children == nil {
+			node.children = make(map[string]*treeNode)
+		}
+		child, ok := node.children[segment]
+		if !ok {
+			child = &treeNode{name: segment}
+			node.children[segment] = child
+		}
+		node = child
+		node.addSize(size)
+	}
+}
+
+// addSize adds the size of one object to the node
+func (n *treeNode) addSize(size int64) {
+	if size < 0 {
+		n.unknown++
+		return
+	}
+	n.size += size
+}
+
+// sizeLabel returns the size of the node, ? for a key of unknown size, and
+// the known total followed by + ? for a directory holding keys of unknown size,
+// even if the known total is 0
+func (n *treeNode) sizeLabel() string {
+	switch {
+	case n.unknown == 0:
+		return formatBytes(n.size)
+	case n.children == nil:
+		return "?"
+	}
+	return formatBytes(n.size) + " + ?"
+}
+
+// sortedChildren returns the children of the node ordered by name
+func (n *treeNode) sortedChildren() []*treeNode {
+	children := make([]*treeNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+// buildKeyTree splits every key on "/" and merges the segments into a tree
+func buildKeyTree(objects []s3Object) *treeNode {
+	root := &treeNode{name: "."}
+	for _, object := range objects {
+		root.add(strings.Split(treePath(object), "/"), object.Size)
+	}
+	return root
+}
+
+// treePath returns the path of an object in the key tree. When keys are
+// prefixed with the bucket URL (-U), the scheme is dropped so each bucket host
+// becomes a top-level node.
+func treePath(object s3Object) string {
+	key := object.displayKey()
+	if i := strings.Index(key, "://"); i >= 0 {
+		key = key[i+len("://"):]
+	}
+	return key
+}
+
+// treeConnectors are the strings that draw the branches of the tree
+type treeConnectors struct {
+	branch, last     string // before a child, and before the last child
+	pipe, lastIndent string // indent below a child, and below the last child
+}
+
+var (
+	boxConnectors   = treeConnectors{"├── ", "└── ", "│   ", "    "}
+	asciiConnectors = treeConnectors{"|-- ", "`-- ", "|   ", "    "}
+)
+
+// connectorsFor returns box-drawing connectors on a terminal and ASCII ones
+// when stdout is redirected, -no-color is given or NO_COLOR is set, for files
+// and terminals without Unicode
+func connectorsFor() treeConnectors {
+	if *noColor || !isTerminal(os.Stdout) || os.Getenv("NO_COLOR") != "" {
+		return asciiConnectors
+	}
+	return boxConnectors
+}
+
+// printKeyTree renders the keys as an indented tree, like the tree command,
+// with the aggregated size of every file and directory
+func printKeyTree(w io.Writer, objects []s3Object) {
+	root := buildKeyTree(objects)
+	fmt.Fprintf(w, "%s [%s]\n", root.name, root.sizeLabel())
+	printTreeChildren(w, root, "", connectorsFor())
+}
+
+// printTreeChildren writes the children of a node with the given connectors
+func printTreeChildren(w io.Writer, node *treeNode, indent string, connectors treeConnectors) {
+	children := node.sortedChildren()
+	for i, child := range children {
+		connector, childIndent := connectors.branch, connectors.pipe
+		if i == len(children)-1 {
+			connector, childIndent = connectors.last, connectors.lastIndent
+		}
+		fmt.Fprintf(w, "%s%s%s [%s]\n", indent, connector, child.name, child.sizeLabel())
+		printTreeChildren(w, child, indent+childIndent, connectors)
+	}
+}
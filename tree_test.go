@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintKeyTree(t *testing.T) {
+	defer func(ascii bool) { *noColor = ascii }(*noColor)
+	*noColor = true
+	objects := []s3Object{
+		{Key: "logs/a.txt", Size: 10},
+		{Key: "logs/b.txt", Size: -1},
+		{Key: "input/c.json", Size: -1},
+		{Key: "readme", Size: 0},
+	}
+	var out bytes.Buffer
+	printKeyTree(&out, objects)
+	want := ". [10 B + ?]\n" +
+		"|-- input [0 B + ?]\n" +
+		"|   `-- c.json [?]\n" +
+		"|-- logs [10 B + ?]\n" +
+		"|   |-- a.txt [10 B]\n" +
+		"|   `-- b.txt [?]\n" +
+		"`-- readme [0 B]\n"
+	if out.String() != want {
+		t.Errorf("got tree\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// watchBuckets lists the buckets every -watch interval until the process is
+// interrupted and prints what changed since the previous listing, with a
+// timestamp per cycle. The first listing is compared with the -diff report if
+// one is given, otherwise it is the baseline of the next one. A listing that
+// takes longer than the interval is followed by the next one right away.
+func watchBuckets(w io.Writer, interval time.Duration, previous []s3Object) int {
+	baseline := *diffFile
+	for cycle := 1; ; cycle++ {
+		start := time.Now()
+		objects, listings := collectObjects()
+		current := filterObjects(scopeObjects(objects))
+
+		stamp := start.UTC().Format(time.RFC3339)
+		if cycle == 1 && baseline == "" {
+			fmt.Fprintf(w, "%s cycle %d: %d keys listed (baseline)\n", stamp, cycle, len(current))
+		} else {
+			diff := diffListings(baseline, previous, current, listings)
+			fmt.Fprintf(w, "%s cycle %d: %d keys listed, %s\n", stamp, cycle, len(current), diff.totals())
+			diff.printKeys(w)
+			notifyNewKeys(diff)
+		}
+		previous, baseline = current, "the previous cycle"
+
+		time.Sleep(time.Until(start.Add(interval)))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webhookMaxKeys is the most keys listed in the text of a notification; the
+// keys array always holds all of them
+const webhookMaxKeys = 20
+
+// webhookClient sends -webhook notifications. It is separate from httpClient
+// so that notifications are never signed with the AWS credentials, traced or
+// retried like bucket requests.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookPayload is the JSON document POSTed to -webhook. The text is also
+// sent as content, so that Slack and Discord webhooks display it as is.
+type webhookPayload struct {
+	Source      string         `json:"source"` // always "s3explorer"
+	Event       string         `json:"event"`  // new_keys or audit_findings
+	GeneratedAt time.Time      `json:"generated_at"`
+	Text        string         `json:"text"`
+	Content     string         `json:"content"`
+	Keys        []jsonObject   `json:"keys,omitempty"`     // new_keys: the keys that appeared
+	Findings    []auditFinding `json:"findings,omitempty"` // audit_findings: the high-severity findings
+}
+
+// auditFinding is a finding together with the bucket it was found on
+type auditFinding struct {
+	URL string `json:"url"`
+	finding
+}
+
+// notifyNewKeys sends a new_keys notification for the keys added according
+// to -diff or a -watch cycle, if there are any
+func notifyNewKeys(diff *listingDiff) {
+	if *webhook == "" || diff == nil || len(diff.added) == 0 {
+		return
+	}
+	payload := webhookPayload{Event: "new_keys"}
+	lines := []string{fmt.Sprintf("s3explorer: %d new keys since %s", len(diff.added), diff.previousFile)}
+	for i, object := range diff.added {
+		payload.Keys = append(payload.Keys, newJSONObject(object))
+		if i < webhookMaxKeys {
+			lines = append(lines, object.url())
+		}
+	}
+	if len(diff.added) > webhookMaxKeys {
+		lines = append(lines, fmt.Sprintf("and %d more", len(diff.added)-webhookMaxKeys))
+	}
+	payload.Text = strings.Join(lines, "\n")
+	sendWebhook(payload)
+}
+
+// notifyAuditFindings sends an audit_findings notification for the
+// high-severity -audit findings, such as writable buckets, if there are any
+func notifyAuditFindings() {
+	if *webhook == "" {
+		return
+	}
+	payload := webhookPayload{Event: "audit_findings"}
+	lines := []string{""}
+	for _, report := range audits {
+		for _, f := range report.Findings {
+			if f.Severity == severityHigh {
+				payload.Findings = append(payload.Findings, auditFinding{URL: report.URL, finding: f})
+				lines = append(lines, fmt.Sprintf("[%s] %s %s: %s", strings.ToUpper(f.Severity), report.URL, f.Check, f.Summary))
+			}
+		}
+	}
+	if len(payload.Findings) == 0 {
+		return
+	}
+	lines[0] = fmt.Sprintf("s3explorer: %d high-severity audit findings", len(payload.Findings))
+	payload.Text = strings.Join(lines, "\n")
+	sendWebhook(payload)
+}
+
+// sendWebhook POSTs a notification to -webhook. Failures are logged and do
+// not stop the scan.
+func sendWebhook(payload webhookPayload) {
+	payload.Source = "s3explorer"
+	payload.GeneratedAt = time.Now().UTC()
+	payload.Content = payload.Text
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode the -webhook notification: %v", err)
+		return
+	}
+	resp, err := webhookClient.Post(*webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		// Webhook URLs embed their secret token, so only the cause is logged
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		log.Printf("Failed to send the -webhook notification: %v", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("The -webhook notification was rejected with status %d", resp.StatusCode)
+		return
+	}
+	debugLog("Sent a %s notification to -webhook", payload.Event)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WebsiteConfiguration is the XML returned by GET ?website
+type WebsiteConfiguration struct {
+	IndexDocument struct {
+		Suffix string `xml:"Suffix"`
+	} `xml:"IndexDocument"`
+	ErrorDocument struct {
+		Key string `xml:"Key"`
+	} `xml:"ErrorDocument"`
+	RedirectAllRequestsTo struct {
+		HostName string `xml:"HostName"`
+		Protocol string `xml:"Protocol"`
+	} `xml:"RedirectAllRequestsTo"`
+	RoutingRules []struct{} `xml:"RoutingRules>RoutingRule"`
+}
+
+// websiteResult is what a bucket's static website configuration shows
+type websiteResult struct {
+	Readable      bool   // the configuration could be read, or is known to be absent
+	Configured    bool   // the bucket is configured as a static website
+	Error         string // S3 error code when the configuration could not be read
+	IndexDocument string
+	ErrorDocument string
+	RedirectTo    string // host all requests are redirected to, if any
+	RoutingRules  int
+}
+
+// String summarizes the configuration, e.g. "index index.html, error error.html"
+func (r websiteResult) String() string {
+	switch {
+	case !r.Readable:
+		return "unknown (" + r.Error + ")"
+	case !r.Configured:
+		return "not configured (" + r.Error + ")"
+	case r.RedirectTo != "":
+		return "redirects all requests to " + r.RedirectTo
+	}
+	var parts []string
+	if r.IndexDocument != "" {
+		parts = append(parts, "index "+r.IndexDocument)
+	}
+	if r.ErrorDocument != "" {
+		parts = append(parts, "error "+r.ErrorDocument)
+	}
+	if r.RoutingRules > 0 {
+		parts = append(parts, fmt.Sprintf("%d routing rules", r.RoutingRules))
+	}
+	return "static website (" + strings.Join(parts, ", ") + ")"
+}
+
+// checkBucketWebsite reads the static website configuration of a bucket. A
+// bucket without one answers NoSuchWebsiteConfiguration, which is a definite
+// "not configured" rather than an error.
+func checkBucketWebsite(bucketURL string) websiteResult {
+	resp, body, err := getSubresource(bucketURL, "website")
+	if err != nil {
+		debugLog("Failed to read the website configuration of %s: %v", bucketURL, err)
+		return websiteResult{Error: "request failed"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		code := s3ErrorCode(resp.StatusCode, body)
+		return websiteResult{Readable: code == "NoSuchWebsiteConfiguration", Error: code}
+	}
+	var config WebsiteConfiguration
+	if err := xml.Unmarshal(body, &config); err != nil {
+		debugLog("Error parsing the website configuration of %s: %v", bucketURL, err)
+		return websiteResult{Error: "parse error"}
+	}
+
+	result := websiteResult{
+		Readable:      true,
+		Configured:    true,
+		IndexDocument: config.IndexDocument.Suffix,
+		ErrorDocument: config.ErrorDocument.Key,
+		RoutingRules:  len(config.RoutingRules),
+	}
+	if host := config.RedirectAllRequestsTo.HostName; host != "" {
+		result.RedirectTo = host
+		if protocol := config.RedirectAllRequestsTo.Protocol; protocol != "" {
+			result.RedirectTo = protocol + "://" + host
+		}
+	}
+	return result
+}
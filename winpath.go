@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// windowsMaxPath is MAX_PATH, the longest path most Windows APIs accept
+// without the \\?\ prefix (including the terminating NUL)
+const windowsMaxPath = 260
+
+// windowsReserved are device names Windows does not allow as file names,
+// with or without an extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// platformSafePath makes a local path valid on the platform the tool runs on.
+// Only Windows restricts names beyond the separator, so elsewhere the path is
+// returned unchanged.
+func platformSafePath(p string) string {
+	if runtime.GOOS != "windows" {
+		return p
+	}
+	return windowsSafePath(p)
+}
+
+// windowsSafePath rewrites every segment of a path into a name Windows accepts:
+// the characters <>:"|?* and control characters become "_", trailing dots
+// and spaces are dropped, and reserved device names get a "_" appended to
+// their base name (CON.txt becomes CON_.txt)
+func windowsSafePath(p string) string {
+	segments := strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' })
+	for i, segment := range segments {
+		segment = strings.Map(func(r rune) rune {
+			if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+				return '_'
+			}
+			return r
+		}, segment)
+		if trimmed := strings.TrimRight(segment, ". "); trimmed != "" {
+			segment = trimmed
+		} else {
+			segment = "_"
+		}
+		base, _, _ := strings.Cut(segment, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+			segment = base + "_" + segment[len(base):]
+		}
+		segments[i] = segment
+	}
+	return strings.Join(segments, `\`)
+}
+
+// longPath returns p in the \\?\ form on Windows when its absolute path is
+// longer than MAX_PATH, which lets the file APIs create deeply nested keys.
+// Shorter paths and other platforms are returned unchanged.
+func longPath(p string) string {
+	if runtime.GOOS != "windows" || strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil || len(abs) < windowsMaxPath {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path: \\server\share becomes \\?\UNC\server\share
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWindowsSafePath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"logs/2023/a.txt", `logs\2023\a.txt`},
+		{`already\windows\a.txt`, `already\windows\a.txt`},
+		{"CON", "CON_"},
+		{"con.txt", "con_.txt"},
+		{"dir/NUL.tar.gz", `dir\NUL_.tar.gz`},
+		{"COM1/LPT9.log", `COM1_\LPT9_.log`},
+		{"CONSOLE.txt", "CONSOLE.txt"},
+		{"COM10", "COM10"},
+		{"AUX .txt", "AUX _.txt"},
+		{`a<b>c:d"e|f?g*h.txt`, "a_b_c_d_e_f_g_h.txt"},
+		{"tab\there\x01.txt", "tab_here_.txt"},
+		{"trailing. . /name ", `trailing\name`},
+		{"dots/...", `dots\_`},
+	}
+	for _, test := range tests {
+		if got := windowsSafePath(test.path); got != test.want {
+			t.Errorf("windowsSafePath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestPlatformSafePath(t *testing.T) {
+	got := platformSafePath("dir/CON.txt")
+	want := "dir/CON.txt"
+	if runtime.GOOS == "windows" {
+		want = `dir\CON_.txt`
+	}
+	if got != want {
+		t.Errorf("platformSafePath = %q, want %q", got, want)
+	}
+}
+
+func TestLongPath(t *testing.T) {
+	short := filepath.Join("logs", "a.txt")
+	if got := longPath(short); got != short {
+		t.Errorf("longPath(%q) = %q", short, got)
+	}
+	long := filepath.Join(strings.Repeat("d", 200), strings.Repeat("f", 100)+".txt")
+	got := longPath(long)
+	if runtime.GOOS != "windows" {
+		if got != long {
+			t.Errorf("longPath changed %q to %q outside of Windows", long, got)
+		}
+		return
+	}
+	abs, err := filepath.Abs(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != `\\?\`+abs {
+		t.Errorf("longPath(%q) = %q, want the \\\\?\\ form of %q", long, got, abs)
+	}
+	if again := longPath(got); again != got {
+		t.Errorf("longPath prefixed %q again: %q", got, again)
+	}
+}